@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// TagAlias - alternative name resolving to a canonical Tag, e.g. "nyc" for "new-york"
+type TagAlias struct {
+	gorm.Model
+	Name        string `json:"name" gorm:"not null"`
+	DisplayName string `json:"display_name"`
+	SearchKey   string `json:"-" gorm:"not null;default:''"`
+	TagID       uint   `json:"tag_id" gorm:"not null;index"`
+	Tag         *Tag   `json:"tag,omitempty" gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// normalize sets the canonical Name, which may include a namespace, keeping what the client
+// sent as the DisplayName
+func (a *TagAlias) normalize() error {
+	tag := Tag{Name: a.Name, DisplayName: a.DisplayName}
+	if err := tag.normalize(); err != nil {
+		return err
+	}
+	a.Name, a.DisplayName = tag.qualifiedName(), tag.DisplayName
+	return nil
+}
+
+// BeforeSave keeps the search key in step with the name, without the namespace
+func (a *TagAlias) BeforeSave(tx *gorm.DB) error {
+	if a.Name != "" {
+		_, name := splitTagName(a.Name)
+		a.SearchKey = searchKey(name)
+	}
+	return nil
+}
+
+// Aliases - HTTP methods for tag alias operations
+func Aliases(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.URL.Path != "/v1/aliases" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		query := db.Preload("Tag").Order("name")
+		// optionally only the aliases of one tag
+		if tagIDStr := r.URL.Query().Get("tag"); tagIDStr != "" {
+			tagID, err := strconv.ParseUint(tagIDStr, 10, 32)
+			if err != nil {
+				http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+				return
+			}
+			query = query.Where("tag_id = ?", uint(tagID))
+		}
+		aliases := []TagAlias{}
+		if result := query.Find(&aliases); result.Error != nil {
+			http.Error(w, "Failed to fetch aliases", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(aliases); err != nil {
+			http.Error(w, "Failed to encode aliases", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost:
+		var alias TagAlias
+		if err := json.NewDecoder(r.Body).Decode(&alias); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if err := alias.normalize(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		alias.Tag = nil
+		if !saveAlias(w, db, &alias) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(alias)
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SingleAlias - HTTP methods for operations on one alias, addressed by ID or name
+func SingleAlias(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	idOrName := r.PathValue("id")
+	if idOrName == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var alias TagAlias
+		if !loadAlias(w, db, idOrName, &alias) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(alias); err != nil {
+			http.Error(w, "Failed to encode alias", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPatch:
+		var alias TagAlias
+		if !loadAlias(w, db, idOrName, &alias) {
+			return
+		}
+
+		var patch struct {
+			Name  *string `json:"name"`
+			TagID *uint   `json:"tag_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if patch.Name != nil {
+			alias.Name, alias.DisplayName = *patch.Name, ""
+			if err := alias.normalize(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if patch.TagID != nil {
+			alias.TagID = *patch.TagID
+		}
+		alias.Tag = nil
+		if !saveAlias(w, db, &alias) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(alias); err != nil {
+			http.Error(w, "Failed to encode alias", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodDelete:
+		var alias TagAlias
+		if !loadAlias(w, db, idOrName, &alias) {
+			return
+		}
+		// hard delete, the soft deleted row would keep holding the unique name
+		if err := db.Unscoped().Delete(&alias).Error; err != nil {
+			http.Error(w, "Failed to delete alias", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, PATCH, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveAlias validates and stores a new or changed alias, writing the error response if it can't
+func saveAlias(w http.ResponseWriter, db *gorm.DB, alias *TagAlias) bool {
+	var tag Tag
+	if err := db.First(&tag, alias.TagID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Tag not found", http.StatusBadRequest)
+			return false
+		}
+		http.Error(w, "Failed to fetch tag", http.StatusInternalServerError)
+		return false
+	}
+	// an alias shadowing a tag would make the name ambiguous
+	var count int64
+	if err := whereTagName(db.Model(&Tag{}), alias.Name).Count(&count).Error; err != nil {
+		http.Error(w, "Failed to save alias", http.StatusInternalServerError)
+		return false
+	}
+	if count > 0 {
+		http.Error(w, "Tag with this name already exists", http.StatusConflict)
+		return false
+	}
+	var existing TagAlias
+	if result := db.Where("name = ? AND id <> ?", alias.Name, alias.ID).Limit(1).Find(&existing); result.RowsAffected > 0 {
+		http.Error(w, "Alias with this name already exists", http.StatusConflict)
+		return false
+	}
+
+	if err := db.Save(alias).Error; err != nil {
+		if isUniqueViolation(err) {
+			http.Error(w, "Alias with this name already exists", http.StatusConflict)
+			return false
+		}
+		http.Error(w, "Failed to save alias", http.StatusInternalServerError)
+		return false
+	}
+	alias.Tag = &tag
+	return true
+}
+
+// findAlias looks an alias up by numeric ID, falling back to its name
+func findAlias(db *gorm.DB, idOrName string, alias *TagAlias) error {
+	if id, err := strconv.ParseUint(idOrName, 10, 32); err == nil {
+		err := db.Preload("Tag").First(alias, uint(id)).Error
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+	}
+	return db.Preload("Tag").Where("name = ?", normalizeQualifiedName(idOrName)).First(alias).Error
+}
+
+// loadAlias fetches an alias for an item route, writing the error response if it can't
+func loadAlias(w http.ResponseWriter, db *gorm.DB, idOrName string, alias *TagAlias) bool {
+	if err := findAlias(db, idOrName, alias); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Alias not found", http.StatusNotFound)
+			return false
+		}
+		http.Error(w, "Failed to fetch alias", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// aliasExists reports whether a normalized qualified name is taken by an alias
+func aliasExists(db *gorm.DB, name string) (bool, error) {
+	var count int64
+	err := db.Model(&TagAlias{}).Where("name = ?", name).Count(&count).Error
+	return count > 0, err
+}
+
+// resolveAliases maps normalized qualified names that are aliases onto their canonical tags, the
+// returned tags carry the alias that matched
+func resolveAliases(db *gorm.DB, names []string) (map[string]Tag, error) {
+	resolved := map[string]Tag{}
+	if len(names) == 0 {
+		return resolved, nil
+	}
+	var aliases []TagAlias
+	if err := db.Preload("Tag").Where("name IN ?", names).Find(&aliases).Error; err != nil {
+		return nil, err
+	}
+	for _, alias := range aliases {
+		if alias.Tag == nil {
+			continue
+		}
+		tag := *alias.Tag
+		tag.MatchedAlias = alias.Name
+		resolved[alias.Name] = tag
+	}
+	return resolved, nil
+}
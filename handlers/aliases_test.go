@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateAlias(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	tag := Tag{Name: "new-york"}
+	db.Create(&tag)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/aliases", func(w http.ResponseWriter, r *http.Request) {
+		Aliases(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"name":"NYC","tag_id":%d}`, tag.ID)
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/aliases", bytes.NewBufferString(body)))
+
+	if status := recorder.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var alias TagAlias
+	if err := json.Unmarshal(recorder.Body.Bytes(), &alias); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Equal(t, "nyc", alias.Name)
+	assert.Equal(t, "NYC", alias.DisplayName)
+	assert.Equal(t, tag.ID, alias.TagID)
+
+	// an alias name can't be reused, nor can it shadow a tag
+	for _, name := range []string{"nyc", "New-York"} {
+		recorder = httptest.NewRecorder()
+		body = fmt.Sprintf(`{"name":%q,"tag_id":%d}`, name, tag.ID)
+		mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/aliases", bytes.NewBufferString(body)))
+		assert.Equal(t, http.StatusConflict, recorder.Code, "creating alias %q", name)
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/aliases", bytes.NewBufferString(`{"name":"big apple","tag_id":909345}`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/aliases?tag=%d", tag.ID), nil))
+	var aliases []TagAlias
+	json.Unmarshal(recorder.Body.Bytes(), &aliases)
+	assert.Len(t, aliases, 1)
+}
+
+func TestTagNameTakenByAlias(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	tag := Tag{Name: "new-york"}
+	db.Create(&tag)
+	db.Create(&TagAlias{Name: "nyc", TagID: tag.ID})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags", func(w http.ResponseWriter, r *http.Request) {
+		Tags(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/tags", bytes.NewBufferString(`{"Name":"NYC"}`)))
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, "Alias with this name already exists\n", recorder.Body.String())
+}
+
+func TestUpdateAndDeleteAlias(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	tag1 := Tag{Name: "new-york"}
+	tag2 := Tag{Name: "manhattan"}
+	db.Create(&tag1)
+	db.Create(&tag2)
+	alias := TagAlias{Name: "nyc", TagID: tag1.ID}
+	db.Create(&alias)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/aliases/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleAlias(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"tag_id":%d}`, tag2.ID)
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPatch, "/v1/aliases/nyc", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var stored TagAlias
+	db.First(&stored, alias.ID)
+	assert.Equal(t, tag2.ID, stored.TagID)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/v1/aliases/%d", alias.ID), nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/aliases/nyc", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestUploadResolvesAlias(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	tag := Tag{Name: "new-york"}
+	db.Create(&tag)
+	db.Create(&TagAlias{Name: "nyc", TagID: tag.ID})
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "media1", "Tags": `[{"Name":"NYC"}, {"Name":"new-york"}]`}, "../static/tests/bg.png"))
+
+	if status := recorder.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var respMedia Media
+	if err := json.Unmarshal(recorder.Body.Bytes(), &respMedia); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Len(t, respMedia.Tags, 1, "Expected the alias and the tag to collapse into one")
+	assert.Equal(t, tag.ID, respMedia.Tags[0].ID)
+	assert.Equal(t, "nyc", respMedia.Tags[0].MatchedAlias)
+
+	var count int64
+	db.Model(&Tag{}).Count(&count)
+	assert.Equal(t, int64(1), count, "Expected no tag to be created for the alias")
+}
+
+func TestFilterMediaByAlias(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	tag := Tag{Name: "new-york"}
+	db.Create(&tag)
+	db.Create(&TagAlias{Name: "nyc", TagID: tag.ID})
+	db.Create(&Media{Name: "media1", Tags: []*Tag{&tag}})
+	db.Create(&Media{Name: "media2"})
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media?q=NYC", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var mediaResp []Media
+	if err := json.Unmarshal(recorder.Body.Bytes(), &mediaResp); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Len(t, mediaResp, 1)
+	assert.Equal(t, "media1", mediaResp[0].Name)
+	assert.Equal(t, "nyc", mediaResp[0].Tags[0].MatchedAlias)
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Blob - one stored file, shared by every Media with the same content
+type Blob struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	SHA256    string `gorm:"uniqueIndex;size:64;not null"`
+	Key       string `gorm:"not null"`
+	Size      int64
+	RefCount  int `gorm:"not null;default:0"`
+}
+
+// acquireBlob takes a reference on the blob holding the content with the given hash, registering
+// the freshly stored object under key if the content is new. It returns the key Media should use,
+// which is an older copy when the content was already stored.
+func acquireBlob(tx *gorm.DB, sum, key string, size int64) (string, error) {
+	var blob Blob
+	err := tx.Raw(`INSERT INTO blobs (created_at, sha256, key, size, ref_count) VALUES (?, ?, ?, ?, 1)
+		ON CONFLICT (sha256) DO UPDATE SET ref_count = blobs.ref_count + 1
+		RETURNING key`, time.Now(), sum, key, size).Scan(&blob).Error
+	if err != nil {
+		return "", err
+	}
+	return blob.Key, nil
+}
+
+// releaseBlob drops a reference on the blob with the given hash and returns the key of its
+// stored object once nothing refers to it anymore, so the caller can remove it after commit
+func releaseBlob(tx *gorm.DB, sum string) (string, error) {
+	if err := tx.Exec("UPDATE blobs SET ref_count = ref_count - 1 WHERE sha256 = ?", sum).Error; err != nil {
+		return "", err
+	}
+	var blobs []Blob
+	if err := tx.Raw("DELETE FROM blobs WHERE sha256 = ? AND ref_count <= 0 RETURNING key", sum).Scan(&blobs).Error; err != nil {
+		return "", err
+	}
+	if len(blobs) == 0 {
+		return "", nil
+	}
+	return blobs[0].Key, nil
+}
+
+// discardFile removes a stored object that turned out not to be needed, logging failures
+// since the request it belonged to has already succeeded or failed for other reasons
+func discardFile(ctx context.Context, key string) {
+	if err := removeFile(context.WithoutCancel(ctx), key); err != nil {
+		log.Printf("failed to remove stored file %q: %v", key, err)
+	}
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// AllowedContentTypes lists the media types uploads may have, "type/*" allows a whole top-level type.
+// main sets it from ALLOWED_CONTENT_TYPES.
+var AllowedContentTypes = []string{"image/*", "video/*", "audio/*", "application/pdf"}
+
+// contentTypeAliases maps alternative names for a media type onto the one detectContentType reports
+var contentTypeAliases = map[string]string{
+	"image/jpg":       "image/jpeg",
+	"image/pjpeg":     "image/jpeg",
+	"audio/mp3":       "audio/mpeg",
+	"audio/x-wav":     "audio/wave",
+	"audio/wav":       "audio/wave",
+	"audio/vnd.wave":  "audio/wave",
+	"video/x-msvideo": "video/avi",
+	"audio/x-aiff":    "audio/aiff",
+	"application/ogg": "audio/ogg",
+	"video/ogg":       "audio/ogg",
+	"video/matroska":  "video/x-matroska",
+}
+
+// quickTimeAtoms are the top-level atoms QuickTime files made before the ftyp atom may start with
+var quickTimeAtoms = []string{"moov", "mdat", "wide", "pnot"}
+
+// detectContentType sniffs content like http.DetectContentType, which doesn't know the QuickTime and
+// Matroska containers most cameras and screen recorders write video in
+func detectContentType(head []byte) string {
+	contentType := http.DetectContentType(head)
+	switch {
+	case contentType == "application/octet-stream" && isQuickTime(head):
+		return "video/quicktime"
+	// every EBML document passes for WebM
+	case contentType == "video/webm" && isMatroska(head):
+		return "video/x-matroska"
+	}
+	return contentType
+}
+
+// isQuickTime looks for an ftyp atom naming the qt brand, or an atom only QuickTime files start with
+func isQuickTime(head []byte) bool {
+	if len(head) < 12 {
+		return false
+	}
+	atom := string(head[4:8])
+	if atom != "ftyp" {
+		for _, quickTime := range quickTimeAtoms {
+			if atom == quickTime {
+				return true
+			}
+		}
+		return false
+	}
+	// the major brand, then the compatible brands after the minor version
+	size := int(min(binary.BigEndian.Uint32(head), uint32(len(head))))
+	for offset := 8; offset+4 <= size; offset += 4 {
+		if offset != 12 && string(head[offset:offset+4]) == "qt  " {
+			return true
+		}
+	}
+	return false
+}
+
+// isMatroska looks for the matroska document type in the EBML header
+func isMatroska(head []byte) bool {
+	return bytes.Contains(head[:min(len(head), 64)], []byte("matroska"))
+}
+
+// contentTypeError - upload refused because of its content, Status is the response code
+type contentTypeError struct {
+	Status int
+	Msg    string
+}
+
+func (e *contentTypeError) Error() string {
+	return e.Msg
+}
+
+// baseMediaType strips the parameters from a content type and resolves aliases
+func baseMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+	if canonical, ok := contentTypeAliases[mediaType]; ok {
+		return canonical
+	}
+	return mediaType
+}
+
+// contentTypeAllowed reports whether the detected content type is on the allowlist
+func contentTypeAllowed(contentType string) bool {
+	mediaType := baseMediaType(contentType)
+	for _, allowed := range AllowedContentTypes {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "*/*" || allowed == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContentType refuses content types that aren't allowed, and file names whose extension
+// promises a different type than the content has. Unknown extensions aren't held against the file.
+func checkContentType(contentType, filename string) error {
+	if !contentTypeAllowed(contentType) {
+		return &contentTypeError{
+			Status: http.StatusUnsupportedMediaType,
+			Msg:    fmt.Sprintf("Content type %s is not allowed", baseMediaType(contentType)),
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		return nil
+	}
+	if expected := mime.TypeByExtension(ext); expected != "" && baseMediaType(expected) != baseMediaType(contentType) {
+		return &contentTypeError{
+			Status: http.StatusBadRequest,
+			Msg:    fmt.Sprintf("File extension %s doesn't match the content type %s", ext, baseMediaType(contentType)),
+		}
+	}
+	return nil
+}
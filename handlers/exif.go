@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// EXIF tags read from the IFDs of a JPEG
+const (
+	exifMake             = 0x010f
+	exifModel            = 0x0110
+	exifDateTime         = 0x0132
+	exifIFDPointer       = 0x8769
+	exifGPSPointer       = 0x8825
+	exifDateTimeOriginal = 0x9003
+	exifOffsetOriginal   = 0x9011
+	gpsLatitudeRef       = 0x0001
+	gpsLatitude          = 0x0002
+	gpsLongitudeRef      = 0x0003
+	gpsLongitude         = 0x0004
+)
+
+// TIFF field types and their sizes in bytes
+const (
+	tiffASCII    = 2
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+var tiffTypeSizes = map[uint16]uint32{tiffASCII: 1, tiffShort: 2, tiffLong: 4, tiffRational: 8}
+
+// maxExifSegment caps how much of a JPEG is searched for the EXIF segment
+const maxExifSegment = 1 << 20
+
+var errNoExif = errors.New("no EXIF data")
+
+// exifLayout is the time format of EXIF dates
+const exifLayout = "2006:01:02 15:04:05"
+
+// readExifSegment finds the APP1 segment holding EXIF data in a JPEG and returns its TIFF part
+func readExifSegment(r io.Reader) ([]byte, error) {
+	r = io.LimitReader(r, maxExifSegment)
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xff, 0xd8} {
+		return nil, errNoExif
+	}
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errNoExif
+		}
+		if header[0] != 0xff {
+			return nil, errNoExif
+		}
+		// start of scan, the metadata segments are all behind us
+		if header[1] == 0xda || header[1] == 0xd9 {
+			return nil, errNoExif
+		}
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return nil, errNoExif
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoExif
+		}
+		if header[1] == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// tiffReader - reads the IFDs of a TIFF structure held in memory
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry - one field of an IFD, value holds the raw bytes of its values
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func newTiffReader(data []byte) (*tiffReader, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, errNoExif
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, errNoExif
+	}
+	return t, t.order.Uint32(data[4:]), nil
+}
+
+// ifd reads the entries of the IFD at offset, skipping the ones pointing outside the data
+func (t *tiffReader) ifd(offset uint32) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return entries
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	for i := 0; i < count; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(t.data)) {
+			break
+		}
+		raw := t.data[start : start+12]
+		entry := tiffEntry{typ: t.order.Uint16(raw[2:]), count: t.order.Uint32(raw[4:])}
+		size, ok := tiffTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		length := uint64(size) * uint64(entry.count)
+		if length <= 4 {
+			entry.value = raw[8 : 8+length]
+		} else {
+			at := uint64(t.order.Uint32(raw[8:]))
+			if at+length > uint64(len(t.data)) {
+				continue
+			}
+			entry.value = t.data[at : at+length]
+		}
+		entries[t.order.Uint16(raw)] = entry
+	}
+	return entries
+}
+
+func (t *tiffReader) str(e tiffEntry) string {
+	if e.typ != tiffASCII {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (t *tiffReader) uint(e tiffEntry) (uint32, bool) {
+	switch {
+	case e.typ == tiffLong && len(e.value) >= 4:
+		return t.order.Uint32(e.value), true
+	case e.typ == tiffShort && len(e.value) >= 2:
+		return uint32(t.order.Uint16(e.value)), true
+	}
+	return 0, false
+}
+
+func (t *tiffReader) rationals(e tiffEntry) []float64 {
+	if e.typ != tiffRational {
+		return nil
+	}
+	var values []float64
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num, den := t.order.Uint32(e.value[i:]), t.order.Uint32(e.value[i+4:])
+		if den == 0 {
+			return nil
+		}
+		values = append(values, float64(num)/float64(den))
+	}
+	return values
+}
+
+// gpsCoordinate turns degrees, minutes and seconds with their N, S, E or W reference into a signed degree
+func (t *tiffReader) gpsCoordinate(value, ref tiffEntry) (float64, bool) {
+	dms := t.rationals(value)
+	if len(dms) != 3 {
+		return 0, false
+	}
+	degrees := dms[0] + dms[1]/60 + dms[2]/3600
+	if r := t.str(ref); r == "S" || r == "W" {
+		degrees = -degrees
+	}
+	// six decimals are about ten centimeters
+	return math.Round(degrees*1e6) / 1e6, true
+}
+
+// readExif fills the camera, capture time and position from the EXIF data of a JPEG
+func readExif(r io.ReadSeeker, metadata *MediaMetadata) error {
+	segment, err := readExifSegment(r)
+	if err != nil {
+		return err
+	}
+	t, offset, err := newTiffReader(segment)
+	if err != nil {
+		return err
+	}
+	ifd0 := t.ifd(offset)
+
+	camera := strings.TrimSpace(t.str(ifd0[exifMake]) + " " + t.str(ifd0[exifModel]))
+	// most models already start with the make
+	if model := t.str(ifd0[exifModel]); strings.HasPrefix(strings.ToLower(model), strings.ToLower(t.str(ifd0[exifMake]))) {
+		camera = model
+	}
+	metadata.Camera = camera
+
+	taken := t.str(ifd0[exifDateTime])
+	offsetTime := ""
+	if pointer, ok := t.uint(ifd0[exifIFDPointer]); ok {
+		exif := t.ifd(pointer)
+		if original := t.str(exif[exifDateTimeOriginal]); original != "" {
+			taken = original
+			offsetTime = t.str(exif[exifOffsetOriginal])
+		}
+	}
+	if taken != "" {
+		// without an offset the capture time is the camera's wall clock, recorded as UTC
+		var at time.Time
+		var err error
+		if offsetTime != "" {
+			at, err = time.Parse(exifLayout+"-07:00", taken+offsetTime)
+		} else {
+			at, err = time.Parse(exifLayout, taken)
+		}
+		if err == nil {
+			metadata.TakenAt = &at
+		}
+	}
+
+	if pointer, ok := t.uint(ifd0[exifGPSPointer]); ok {
+		gps := t.ifd(pointer)
+		lat, latOK := t.gpsCoordinate(gps[gpsLatitude], gps[gpsLatitudeRef])
+		lon, lonOK := t.gpsCoordinate(gps[gpsLongitude], gps[gpsLongitudeRef])
+		if latOK && lonOK {
+			metadata.GPS = &GPSPosition{Latitude: lat, Longitude: lon}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// errTagCycle is returned when a new parent would make a tag its own ancestor
+var errTagCycle = errors.New("Parent would make the tag its own ancestor")
+
+// errParentNotFound is returned when the requested parent tag doesn't exist
+var errParentNotFound = errors.New("Parent tag not found")
+
+// hierarchyLockKey serializes parent changes, so two concurrent moves can't close a loop together
+const hierarchyLockKey = 7_311_990
+
+// optionalID - JSON field telling a missing value apart from an explicit null
+type optionalID struct {
+	Set bool
+	ID  *uint
+}
+
+func (o *optionalID) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	return json.Unmarshal(data, &o.ID)
+}
+
+// tagNode - tag with its children, as returned by the tree endpoint
+type tagNode struct {
+	Tag
+	Children []*tagNode `json:"children"`
+}
+
+// setParent validates a new parent for the tag inside tx, which must be a transaction
+func setParent(tx *gorm.DB, tag *Tag, parentID *uint) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", hierarchyLockKey).Error; err != nil {
+		return err
+	}
+	if parentID != nil {
+		var count int64
+		if err := tx.Model(&Tag{}).Where("id = ?", *parentID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return errParentNotFound
+		}
+		if tag.ID != 0 {
+			if *parentID == tag.ID {
+				return errTagCycle
+			}
+			ancestors, err := ancestorIDs(tx, *parentID)
+			if err != nil {
+				return err
+			}
+			for _, id := range ancestors {
+				if id == tag.ID {
+					return errTagCycle
+				}
+			}
+		}
+	}
+	tag.ParentID = parentID
+	return nil
+}
+
+// ancestorIDs returns the IDs above a tag, nearest first
+func ancestorIDs(db *gorm.DB, id uint) ([]uint, error) {
+	var rows []struct {
+		ID    uint
+		Depth int
+	}
+	// UNION rather than UNION ALL so a damaged hierarchy can't recurse forever
+	err := db.Raw(`WITH RECURSIVE ancestors (id, depth) AS (
+			SELECT parent_id, 1 FROM tags WHERE id = ? AND parent_id IS NOT NULL
+			UNION
+			SELECT tags.parent_id, ancestors.depth + 1 FROM tags
+			JOIN ancestors ON tags.id = ancestors.id
+			WHERE tags.parent_id IS NOT NULL AND ancestors.depth < 1000
+		)
+		SELECT id, MIN(depth) AS depth FROM ancestors GROUP BY id ORDER BY depth`, id).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	return ids, nil
+}
+
+// descendantIDs returns the given tags together with every tag below them
+func descendantIDs(db *gorm.DB, ids []uint) ([]uint, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var result []uint
+	err := db.Raw(`WITH RECURSIVE descendants (id) AS (
+			SELECT id FROM tags WHERE id IN ?
+			UNION
+			SELECT tags.id FROM tags JOIN descendants ON tags.parent_id = descendants.id
+		)
+		SELECT id FROM descendants`, ids).Scan(&result).Error
+	return result, err
+}
+
+// TagAncestors - lists the tags above a tag, from the root down to its parent
+func TagAncestors(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	tagRelatives(w, r, db, func(tag Tag) ([]uint, error) {
+		ids, err := ancestorIDs(db, tag.ID)
+		// root first reads like a breadcrumb
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+		return ids, err
+	})
+}
+
+// TagDescendants - lists every tag below a tag
+func TagDescendants(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	tagRelatives(w, r, db, func(tag Tag) ([]uint, error) {
+		ids, err := descendantIDs(db, []uint{tag.ID})
+		below := ids[:0]
+		for _, id := range ids {
+			if id != tag.ID {
+				below = append(below, id)
+			}
+		}
+		return below, err
+	})
+}
+
+// tagRelatives serves a list of tags related to the tag in the path, in the order relatives returns
+func tagRelatives(w http.ResponseWriter, r *http.Request, db *gorm.DB, relatives func(Tag) ([]uint, error)) {
+	idOrName := r.PathValue("id")
+	if idOrName == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var tag Tag
+		if !loadTag(w, db, idOrName, &tag) {
+			return
+		}
+		ids, err := relatives(tag)
+		if err != nil {
+			http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+			return
+		}
+		tags := []Tag{}
+		if len(ids) > 0 {
+			if err := db.Find(&tags, ids).Error; err != nil {
+				http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+				return
+			}
+		}
+		position := map[uint]int{}
+		for i, id := range ids {
+			position[id] = i
+		}
+		sort.Slice(tags, func(i, j int) bool { return position[tags[i].ID] < position[tags[j].ID] })
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tags); err != nil {
+			http.Error(w, "Failed to encode tags", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TagTree - returns the whole taxonomy as nested tags, optionally only below ?root=<id>
+func TagTree(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.URL.Path != "/v1/tags/tree" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var root *uint
+		if rootStr := r.URL.Query().Get("root"); rootStr != "" {
+			id, err := strconv.ParseUint(rootStr, 10, 32)
+			if err != nil {
+				http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+				return
+			}
+			rootID := uint(id)
+			root = &rootID
+		}
+
+		var tags []Tag
+		if err := db.Order("name").Find(&tags).Error; err != nil {
+			http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+			return
+		}
+
+		nodes := map[uint]*tagNode{}
+		for _, tag := range tags {
+			nodes[tag.ID] = &tagNode{Tag: tag, Children: []*tagNode{}}
+		}
+		roots := []*tagNode{}
+		for _, tag := range tags {
+			node := nodes[tag.ID]
+			parent, ok := (*tagNode)(nil), false
+			if tag.ParentID != nil {
+				parent, ok = nodes[*tag.ParentID]
+			}
+			if ok {
+				parent.Children = append(parent.Children, node)
+			} else {
+				roots = append(roots, node)
+			}
+		}
+		if root != nil {
+			node, ok := nodes[*root]
+			if !ok {
+				http.Error(w, "Tag not found", http.StatusNotFound)
+				return
+			}
+			roots = []*tagNode{node}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(roots); err != nil {
+			http.Error(w, "Failed to encode tags", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
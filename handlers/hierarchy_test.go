@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// createHierarchy stores animals > mammals > cats
+func createHierarchy(db *gorm.DB) (animals, mammals, cats Tag) {
+	animals = Tag{Name: "animals"}
+	db.Create(&animals)
+	mammals = Tag{Name: "mammals", ParentID: &animals.ID}
+	db.Create(&mammals)
+	cats = Tag{Name: "cats", ParentID: &mammals.ID}
+	db.Create(&cats)
+	return animals, mammals, cats
+}
+
+func newHierarchyMux(db *gorm.DB) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags", func(w http.ResponseWriter, r *http.Request) { Tags(w, r, db) })
+	mux.HandleFunc("/v1/tags/tree", func(w http.ResponseWriter, r *http.Request) { TagTree(w, r, db) })
+	mux.HandleFunc("/v1/tags/{id}", func(w http.ResponseWriter, r *http.Request) { SingleTag(w, r, db) })
+	mux.HandleFunc("/v1/tags/{id}/ancestors", func(w http.ResponseWriter, r *http.Request) { TagAncestors(w, r, db) })
+	mux.HandleFunc("/v1/tags/{id}/descendants", func(w http.ResponseWriter, r *http.Request) { TagDescendants(w, r, db) })
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) { AllMedia(w, r, db) })
+	return mux
+}
+
+func tagNames(tags []Tag) []string {
+	names := []string{}
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+	return names
+}
+
+func TestTagAncestorsAndDescendants(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	animals, _, cats := createHierarchy(db)
+	mux := newHierarchyMux(db)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/tags/%d/ancestors", cats.ID), nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var ancestors []Tag
+	if err := json.Unmarshal(recorder.Body.Bytes(), &ancestors); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Equal(t, []string{"animals", "mammals"}, tagNames(ancestors), "Expected ancestors from the root down")
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/tags/%d/descendants", animals.ID), nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var descendants []Tag
+	if err := json.Unmarshal(recorder.Body.Bytes(), &descendants); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.ElementsMatch(t, []string{"mammals", "cats"}, tagNames(descendants))
+}
+
+func TestTagTree(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	createHierarchy(db)
+	db.Create(&Tag{Name: "vehicles"})
+
+	recorder := httptest.NewRecorder()
+	newHierarchyMux(db).ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags/tree", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var roots []tagNode
+	if err := json.Unmarshal(recorder.Body.Bytes(), &roots); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	if assert.Len(t, roots, 2) {
+		assert.Equal(t, "animals", roots[0].Name)
+		if assert.Len(t, roots[0].Children, 1) {
+			assert.Equal(t, "mammals", roots[0].Children[0].Name)
+			assert.Len(t, roots[0].Children[0].Children, 1)
+		}
+		assert.Empty(t, roots[1].Children)
+	}
+}
+
+func TestTagParentCycle(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	animals, _, cats := createHierarchy(db)
+	mux := newHierarchyMux(db)
+
+	// moving the root below its own grandchild would close a loop
+	recorder := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"parent_id":%d}`, cats.ID)
+	mux.ServeHTTP(recorder, httptest.NewRequest("PATCH", fmt.Sprintf("/v1/tags/%d", animals.ID), bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	body = fmt.Sprintf(`{"parent_id":%d}`, animals.ID)
+	mux.ServeHTTP(recorder, httptest.NewRequest("PATCH", fmt.Sprintf("/v1/tags/%d", animals.ID), bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusConflict, recorder.Code, "Expected a tag can't be its own parent")
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("PATCH", fmt.Sprintf("/v1/tags/%d", cats.ID), bytes.NewBufferString(`{"parent_id":909345}`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// an explicit null moves the tag to the top level
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("PATCH", fmt.Sprintf("/v1/tags/%d", cats.ID), bytes.NewBufferString(`{"parent_id":null}`)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var stored Tag
+	db.First(&stored, cats.ID)
+	assert.Nil(t, stored.ParentID)
+}
+
+func TestDeleteTagReparentsChildren(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	animals, mammals, cats := createHierarchy(db)
+
+	recorder := httptest.NewRecorder()
+	newHierarchyMux(db).ServeHTTP(recorder, httptest.NewRequest("DELETE", fmt.Sprintf("/v1/tags/%d", mammals.ID), nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	var stored Tag
+	db.First(&stored, cats.ID)
+	if assert.NotNil(t, stored.ParentID) {
+		assert.Equal(t, animals.ID, *stored.ParentID)
+	}
+}
+
+func TestFilterMediaByDescendants(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	animals, _, cats := createHierarchy(db)
+	db.Create(&Media{Name: "tabby", Tags: []*Tag{&cats}})
+	mux := newHierarchyMux(db)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/media?tag=%d", animals.ID), nil))
+	var media []Media
+	json.Unmarshal(recorder.Body.Bytes(), &media)
+	assert.Empty(t, media)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/media?tag=%d&descendants=true", animals.ID), nil))
+	media = nil
+	json.Unmarshal(recorder.Body.Bytes(), &media)
+	if assert.Len(t, media, 1) {
+		assert.Equal(t, "tabby", media[0].Name)
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media?q=animals&descendants=true", nil))
+	media = nil
+	json.Unmarshal(recorder.Body.Bytes(), &media)
+	assert.Len(t, media, 1)
+}
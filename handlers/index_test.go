@@ -16,7 +16,9 @@ func setup() *gorm.DB {
 	if err != nil {
 		panic("Test DB connection failed")
 	}
-	db.AutoMigrate(&Tag{}, &Media{})
+	if err := Migrate(db); err != nil {
+		panic("Test DB migration failed: " + err.Error())
+	}
 	return db
 }
 
@@ -33,6 +35,26 @@ func teardown(db *gorm.DB) {
 	if err := db.Unscoped().Where("1 = 1").Delete(&Media{}).Error; err != nil {
 		panic("Failed to delete records from media table: " + err.Error())
 	}
+	// Delete Uploads
+	if err := db.Exec("DELETE FROM uploads").Error; err != nil {
+		panic("Failed to delete records from uploads table: " + err.Error())
+	}
+	// Delete Blobs
+	if err := db.Exec("DELETE FROM blobs").Error; err != nil {
+		panic("Failed to delete records from blobs table: " + err.Error())
+	}
+	// Delete Jobs
+	if err := db.Exec("DELETE FROM jobs").Error; err != nil {
+		panic("Failed to delete records from jobs table: " + err.Error())
+	}
+	// Delete Rules
+	if err := db.Exec("DELETE FROM tag_rules").Error; err != nil {
+		panic("Failed to delete records from tag_rules table: " + err.Error())
+	}
+	// Delete Aliases
+	if err := db.Exec("DELETE FROM tag_aliases").Error; err != nil {
+		panic("Failed to delete records from tag_aliases table: " + err.Error())
+	}
 	// Delete Tags
 	if err := db.Unscoped().Where("1 = 1").Delete(&Tag{}).Error; err != nil {
 		panic("Failed to delete records from tags table: " + err.Error())
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/bee-keeper/tags-api/jobs"
+	"gorm.io/gorm"
+)
+
+// jobStatuses are the values accepted by the status filter of the jobs list
+var jobStatuses = map[jobs.Status]bool{
+	jobs.StatusPending: true,
+	jobs.StatusRunning: true,
+	jobs.StatusDone:    true,
+	jobs.StatusDead:    true,
+}
+
+// Jobs - lists background jobs newest first, optionally only those with ?status= and ?kind=,
+// at most ?limit= of them
+func Jobs(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.URL.Path != "/v1/jobs" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		query := db.Order("id DESC")
+		params := r.URL.Query()
+		if status := jobs.Status(params.Get("status")); status != "" {
+			if !jobStatuses[status] {
+				http.Error(w, "Invalid status, use pending, running, done or dead", http.StatusBadRequest)
+				return
+			}
+			query = query.Where("status = ?", status)
+		}
+		if kind := params.Get("kind"); kind != "" {
+			query = query.Where("kind = ?", kind)
+		}
+		limit := defaultPageSize
+		if limitStr := params.Get("limit"); limitStr != "" {
+			n, err := strconv.Atoi(limitStr)
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxPageSize)
+		}
+
+		list := []jobs.Job{}
+		if err := query.Limit(limit).Find(&list).Error; err != nil {
+			http.Error(w, "Failed to fetch jobs", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			http.Error(w, "Failed to encode jobs", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SingleJob - returns one background job, to follow its progress
+func SingleJob(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var job jobs.Job
+		if err := db.First(&job, uint(id)).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "Job not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to fetch job", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(job); err != nil {
+			http.Error(w, "Failed to encode job", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
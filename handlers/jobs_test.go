@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bee-keeper/tags-api/jobs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobs(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	first, _ := jobs.Enqueue(db, jobProcessMedia, processMediaPayload{MediaID: 1})
+	second, _ := jobs.Enqueue(db, jobRulesBackfill, struct{}{})
+	db.Model(&first).Update("status", jobs.StatusDead)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/jobs", func(w http.ResponseWriter, r *http.Request) { Jobs(w, r, db) })
+	mux.HandleFunc("/v1/jobs/{id}", func(w http.ResponseWriter, r *http.Request) { SingleJob(w, r, db) })
+
+	tests := []struct {
+		query string
+		ids   []uint
+	}{
+		{"", []uint{second.ID, first.ID}},
+		{"?status=dead", []uint{first.ID}},
+		{"?kind=rules_backfill", []uint{second.ID}},
+		{"?limit=1", []uint{second.ID}},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/jobs"+test.query, nil))
+		if status := recorder.Code; status != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", test.query, status, http.StatusOK)
+		}
+		var list []jobs.Job
+		json.Unmarshal(recorder.Body.Bytes(), &list)
+		var ids []uint
+		for _, job := range list {
+			ids = append(ids, job.ID)
+		}
+		assert.Equal(t, test.ids, ids, test.query)
+	}
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/jobs?status=stuck", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/jobs/%d", first.ID), nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var job jobs.Job
+	json.Unmarshal(recorder.Body.Bytes(), &job)
+	assert.Equal(t, jobs.StatusDead, job.Status)
+	assert.JSONEq(t, `{"media_id":1}`, string(job.Payload))
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/jobs/%d", second.ID+100), nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
@@ -1,27 +1,70 @@
 package handlers
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/bee-keeper/tags-api/storage"
 	"gorm.io/gorm"
 )
 
+// DefaultStorageRoot is where the local backend keeps files unless STORAGE_ROOT says otherwise.
+// Files uploaded before storage backends existed were written there.
+const DefaultStorageRoot = "../static/uploads"
+
+// Store - backend holding the uploaded files, main swaps it for the configured one
+var Store storage.Storage = storage.NewLocal(DefaultStorageRoot)
+
 // Media - data representation
 type Media struct {
 	gorm.Model
-	Name string `json:"name"`
-	Tags []*Tag `json:"tags" gorm:"many2many:media_tags"`
-	URL  string `json:"URL" gorm:"unique"`
-	File []byte `json:"-" gorm:"-"`
+	Name   string `json:"name"`
+	Tags   []*Tag `json:"tags" gorm:"many2many:media_tags"`
+	URL    string `json:"URL" gorm:"-"`
+	Path   string `json:"-"`
+	SHA256 string `json:"sha256" gorm:"index;size:64"`
+	// ContentType is sniffed from the content while it is uploaded
+	ContentType      string `json:"content_type"`
+	Size             int64  `json:"size"`
+	OriginalFilename string `json:"original_filename"`
+	// Metadata is extracted from the content by the processing job
+	Metadata MediaMetadata `json:"metadata" gorm:"type:jsonb;not null;default:'{}'"`
+	// ProcessingStatus tells how far the processing job got, see the processing* constants
+	ProcessingStatus string `json:"processing_status" gorm:"not null;default:'done'"`
+	// RejectionReason tells why rejected media were rejected
+	RejectionReason string `json:"rejection_reason,omitempty"`
+	// ScannedAt is when the content was found clean, it stays empty while scanning is off
+	ScannedAt *time.Time `json:"scanned_at,omitempty"`
+	File      []byte     `json:"-" gorm:"-"`
+}
+
+// AfterFind fills in the download URL, which is derived from the ID rather than stored
+func (m *Media) AfterFind(tx *gorm.DB) error {
+	m.URL = m.contentURL()
+	return nil
+}
+
+// AfterSave fills in the download URL once the ID is known
+func (m *Media) AfterSave(tx *gorm.DB) error {
+	m.URL = m.contentURL()
+	return nil
+}
+
+// contentURL is the API route serving the media's file
+func (m *Media) contentURL() string {
+	return fmt.Sprintf("/v1/media/%d/content", m.ID)
 }
 
 // AllMedia - HTTP methods for media operations
@@ -34,32 +77,55 @@ func AllMedia(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	switch r.Method {
 
 	case http.MethodGet:
-		tagIDStr := r.URL.Query().Get("tag")
-		var medias []Media
+		p, err := parsePage(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		if tagIDStr != "" {
-			tagID, err := strconv.ParseUint(tagIDStr, 10, 32)
-			if err != nil {
-				http.Error(w, "Invalid tag ID", http.StatusBadRequest)
-				return
-			}
+		// Only media matching the tag filters: tag=1,2 (all), any=3,4, not=5 and q=<boolean query>,
+		// and the metadata bounds such as width_gte=1000
+		filter, err := parseMediaFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query, matched, err := filter.apply(db, db.Model(&Media{}))
+		if err != nil {
+			http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+			return
+		}
 
-			// Fetch media associated with the specified tag ID
-			if result := db.Joins("JOIN media_tags ON media_tags.media_id = media.id").
-				Where("media_tags.tag_id = ?", uint(tagID)).
-				Preload("Tags"). // Eager load the tags associated with the media
-				Find(&medias); result.Error != nil {
-				http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
-				return
-			}
-		} else {
+		var total int64
+		if result := query.Session(&gorm.Session{}).Count(&total); result.Error != nil {
+			http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+			return
+		}
 
-			// Fetch all media if no tag is specified
-			if result := db.Preload("Tags").Find(&medias); result.Error != nil {
-				http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
-				return
+		query, err = p.apply(query, "media")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		medias := []Media{}
+		// Eager load the tags associated with the media
+		if result := query.Preload("Tags").Find(&medias); result.Error != nil {
+			http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+			return
+		}
+		next := ""
+		if len(medias) > p.limit {
+			medias = medias[:p.limit]
+			next = p.nextCursor(medias[p.limit-1].Name, medias[p.limit-1].Model)
+		}
+		// show which tags the query reached through an alias
+		for _, media := range medias {
+			for _, tag := range media.Tags {
+				tag.MatchedAlias = matched[tag.ID]
 			}
 		}
+		writePageHeaders(w, r, total, next)
+
 		// Encode media as JSON
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(medias); err != nil {
@@ -68,101 +134,364 @@ func AllMedia(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		}
 
 	case http.MethodPost:
-		// Parse the multipart form (set a 10MB limit for files)
-		err := r.ParseMultipartForm(10 << 20) // 10MB
+		// Stream the upload, the file goes to the storage backend as it arrives, hashed on the way through
+		upload, ok := receiveUpload(w, r)
+		if !ok {
+			return
+		}
+		newMedia, reused, err := createMedia(r.Context(), db, upload)
+		if errors.Is(err, errEmptyTagName) {
+			http.Error(w, "Invalid tags format", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			http.Error(w, "File too large or invalid input", http.StatusBadRequest)
+			http.Error(w, "Error saving media", http.StatusInternalServerError)
+			return
+		}
+		if newMedia.ProcessingStatus == processingRejected {
+			// the rejected Media tells why
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(newMedia)
+			return
+		}
+		if reused {
+			// the content is already known, the existing Media is returned
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(w).Encode(newMedia); err != nil {
+				http.Error(w, "Error encoding response", http.StatusInternalServerError)
+			}
 			return
 		}
 
-		// Retrieve the name from the form fields
-		name := r.FormValue("Name")
-		if name == "" {
-			http.Error(w, "Name is required", http.StatusBadRequest)
+		// Respond with the created media (excluding the file content)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(newMedia); err != nil {
+			http.Error(w, "Error encoding response", http.StatusInternalServerError)
 			return
 		}
 
-		// Retrieve the file from the form
-		file, fileHeader, err := r.FormFile("File")
-		if err != nil {
-			http.Error(w, "File is required", http.StatusBadRequest)
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SingleMedia - HTTP methods for operations on one media item
+func SingleMedia(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var media Media
+		if !loadMedia(w, db, uint(id), &media) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(media); err != nil {
+			http.Error(w, "Failed to encode media", http.StatusInternalServerError)
 			return
 		}
-		defer file.Close()
 
-		orgFilename := fileHeader.Filename
+	case http.MethodPatch:
+		var media Media
+		if !loadMedia(w, db, uint(id), &media) {
+			return
+		}
 
-		// Clean the name to create a valid filename
-		cleanName := sanitizeString(name)
-		// Generate a unique filename hash based on the name and the current time
-		filename := generateUniqueFilename(cleanName) + "_" + sanitizeString(orgFilename)
+		var patch struct {
+			Name *string `json:"name"`
+			Tags *[]Tag  `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if patch.Name != nil && *patch.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
 
-		// Save the file to disk
-		filePath, err := saveFileToDisk(file, filename)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if patch.Name != nil {
+				if err := tx.Model(&media).Update("name", *patch.Name).Error; err != nil {
+					return err
+				}
+			}
+			if patch.Tags != nil {
+				dbTags, err := ensureTags(tx, *patch.Tags)
+				if err != nil {
+					return err
+				}
+				var oldIDs []uint
+				if err := tx.Raw("SELECT tag_id FROM media_tags WHERE media_id = ?", media.ID).Scan(&oldIDs).Error; err != nil {
+					return err
+				}
+				// replace the existing media_tags links with the new set
+				if err := tx.Model(&media).Association("Tags").Replace(dbTags); err != nil {
+					return err
+				}
+				// only the tags that were added or removed change their counts
+				added, removed := diffIDs(oldIDs, tagIDs(dbTags))
+				if err := adjustUsage(tx, added, 1); err != nil {
+					return err
+				}
+				if err := adjustUsage(tx, removed, -1); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, errEmptyTagName) {
+			http.Error(w, "Invalid tags format", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			http.Error(w, "Error saving file", http.StatusInternalServerError)
+			http.Error(w, "Error saving media", http.StatusInternalServerError)
 			return
 		}
 
-		// Extract tags from the form and parse them
-		tagsString := r.FormValue("Tags")
-		var tags []Tag
-		err = json.Unmarshal([]byte(tagsString), &tags)
-		if err != nil {
-			http.Error(w, "Invalid tags format", http.StatusBadRequest)
+		if !loadMedia(w, db, media.ID, &media) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(media); err != nil {
+			http.Error(w, "Failed to encode media", http.StatusInternalServerError)
 			return
 		}
 
-		// Ensure tags exist in the database and create them if necessary
-		var dbTags []*Tag
-		for _, tag := range tags {
-			var existingTag Tag
-			if err := db.Where("name = ?", tag.Name).First(&existingTag).Error; err != nil {
-				if err == gorm.ErrRecordNotFound {
-					// If the tag doesn't exist, create it
-					newTag := Tag{Name: tag.Name}
-					db.Create(&newTag)
-					dbTags = append(dbTags, &newTag)
-				} else {
-					http.Error(w, "Error processing tags", http.StatusInternalServerError)
-					return
-				}
-			} else {
-				dbTags = append(dbTags, &existingTag)
+	case http.MethodDelete:
+		var media Media
+		if !loadMedia(w, db, uint(id), &media) {
+			return
+		}
+		// media without a content hash predate deduplication and own their file outright
+		unusedKey := media.Path
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var detached []uint
+			if err := tx.Raw("DELETE FROM media_tags WHERE media_id = ? RETURNING tag_id", media.ID).Scan(&detached).Error; err != nil {
+				return err
+			}
+			if err := adjustUsage(tx, detached, -1); err != nil {
+				return err
 			}
+			if err := tx.Unscoped().Delete(&media).Error; err != nil {
+				return err
+			}
+			// rejected content never took a blob reference
+			if media.SHA256 == "" || media.ProcessingStatus == processingRejected {
+				return nil
+			}
+			var err error
+			unusedKey, err = releaseBlob(tx, media.SHA256)
+			return err
+		})
+		if err != nil {
+			http.Error(w, "Failed to delete media", http.StatusInternalServerError)
+			return
+		}
+		// only remove the file once the row is gone so a failed delete keeps both
+		if media.ProcessingStatus == processingRejected {
+			discardQuarantined(r.Context(), media.Path)
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
+		if err := removeFile(r.Context(), unusedKey); err != nil {
+			log.Printf("failed to remove file for media %d: %v", media.ID, err)
+		}
+		if unusedKey != "" {
+			discardRenditions(r.Context(), media)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, PATCH, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MediaContent - serves the uploaded file of one media item
+func MediaContent(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
 
-		// Create the media record
-		newMedia := Media{
-			Name: name,
-			URL:  filePath, // Store the file path (or URL if needed)
-			Tags: dbTags,
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		var media Media
+		if err := db.First(&media, uint(id)).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "Media not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+			return
+		}
+		if !contentServable(w, media) {
+			return
 		}
 
-		// Save media details (without the file content, only file path) to the database
-		if err := db.Create(&newMedia).Error; err != nil {
-			http.Error(w, "Error saving media", http.StatusInternalServerError)
+		info, err := Store.Stat(r.Context(), media.Path)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotExist) || errors.Is(err, storage.ErrInvalidKey) {
+				http.Error(w, "Media content not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to open media content", http.StatusInternalServerError)
 			return
 		}
 
-		// Respond with the created media (excluding the file content)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		if err := json.NewEncoder(w).Encode(newMedia); err != nil {
-			http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		file, err := Store.Get(r.Context(), media.Path)
+		if err != nil {
+			http.Error(w, "Failed to open media content", http.StatusInternalServerError)
 			return
 		}
+		defer file.Close()
+
+		// media uploaded before content types were recorded are sniffed on the fly
+		contentType := media.ContentType
+		if contentType == "" {
+			contentType, err = sniffContentType(file)
+			if err != nil {
+				http.Error(w, "Failed to read media content", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// stored files are never rewritten, so their content hash or unique filename make a strong ETag
+		etag := media.SHA256
+		if etag == "" {
+			etag = path.Base(media.Path)
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", `"`+etag+`"`)
+		// ServeContent deals with Range, If-None-Match and If-Modified-Since
+		http.ServeContent(w, r, path.Base(media.Path), info.ModTime, file)
 
 	case http.MethodOptions:
-		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
 		w.WriteHeader(http.StatusNoContent)
 
 	default:
-		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// sniffContentType detects the MIME type from the first bytes of the file and rewinds it
+func sniffContentType(file io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return detectContentType(buf[:n]), nil
+}
+
+// loadMedia fetches a media item with its tags, writing the error response if it can't
+func loadMedia(w http.ResponseWriter, db *gorm.DB, id uint, media *Media) bool {
+	if err := db.Preload("Tags").First(media, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return false
+		}
+		http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// validateTags checks that every tag has a usable name, without touching the database
+func validateTags(tags []Tag) error {
+	for _, tag := range tags {
+		if err := tag.normalize(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureTags returns the stored tags matching the given names, creating any that don't exist yet.
+// Aliases resolve to their canonical tag, which is returned with the alias that matched.
+func ensureTags(db *gorm.DB, tags []Tag) ([]*Tag, error) {
+	normalized := make([]Tag, len(tags))
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		if err := tag.normalize(); err != nil {
+			return nil, err
+		}
+		normalized[i], names[i] = tag, tag.qualifiedName()
+	}
+	// concurrent uploads create tags in the same order, so they can wait on each other but not deadlock
+	order := make([]int, len(tags))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return names[order[i]] < names[order[j]] })
+
+	resolved := make([]Tag, len(tags))
+	for _, i := range order {
+		tag := normalized[i]
+		var existingTag Tag
+		if err := whereTagName(db, names[i]).First(&existingTag).Error; err != nil {
+			if err != gorm.ErrRecordNotFound {
+				return nil, err
+			}
+			aliased, err := resolveAliases(db, []string{names[i]})
+			if err != nil {
+				return nil, err
+			}
+			if canonical, ok := aliased[names[i]]; ok {
+				existingTag = canonical
+			} else {
+				// If the tag doesn't exist, create it, unless a concurrent upload just did
+				existingTag = Tag{Namespace: tag.Namespace, Name: tag.Name, DisplayName: tag.DisplayName}
+				created, err := insertTag(db, &existingTag)
+				if err != nil {
+					return nil, err
+				}
+				if !created {
+					if err := whereTagName(db, names[i]).First(&existingTag).Error; err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		resolved[i] = existingTag
+	}
+
+	var dbTags []*Tag
+	seen := map[uint]bool{}
+	for i := range resolved {
+		// an alias and its canonical name in one list only link the tag once
+		if seen[resolved[i].ID] {
+			continue
+		}
+		seen[resolved[i].ID] = true
+		dbTags = append(dbTags, &resolved[i])
+	}
+	return dbTags, nil
+}
+
 // sanitizeFilename removes all non-ASCII characters, replaces spaces with underscores, and removes any non-alphanumeric characters
 func sanitizeString(name string) string {
 	// Replace spaces with underscores
@@ -181,28 +510,15 @@ func generateUniqueFilename(name string) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// saveFileToDisk writes the file to disk with the given filename and returns the file path
-func saveFileToDisk(file io.Reader, filename string) (string, error) {
-	// Define the directory to save the file
-	uploadDir := "../static/uploads"
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		return "", err
-	}
-
-	// Construct the full file path (you can add a file extension if needed)
-	filePath := filepath.Join(uploadDir, filename)
-
-	// Create the file on disk
-	outFile, err := os.Create(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer outFile.Close()
+// saveFile writes the file to the storage backend under the given filename
+func saveFile(ctx context.Context, file io.Reader, filename string) (storage.Info, error) {
+	return Store.Put(ctx, filename, file)
+}
 
-	// Copy the uploaded file data to the disk file
-	if _, err := io.Copy(outFile, file); err != nil {
-		return "", err
+// removeFile deletes a file written by saveFile
+func removeFile(ctx context.Context, key string) error {
+	if key == "" {
+		return nil
 	}
-
-	return filePath, nil
+	return Store.Delete(ctx, key)
 }
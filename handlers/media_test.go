@@ -2,7 +2,11 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -12,9 +16,12 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 	"testing"
 
+	"github.com/bee-keeper/tags-api/storage"
 	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
 )
 
 func TestCreateMedia(t *testing.T) {
@@ -64,13 +71,13 @@ func TestCreateMedia(t *testing.T) {
 	}
 
 	assert.Equal(t, "media1", respMedia.Name, "The 'name' field should be 'media1'")
-	pattern := `^../static/uploads/.+_bg\.png$`
+	pattern := `^/v1/media/\d+/content$`
 	re, err := regexp.Compile(pattern)
 	if err != nil {
 		t.Fatalf("Failed to compile regex: %v", err)
 	}
 	matched := re.MatchString(respMedia.URL)
-	assert.True(t, matched, "The 'URL' field should match the pattern '^../static/uploads/.+_bg\\.png$'")
+	assert.True(t, matched, "The 'URL' field should match the pattern '^/v1/media/\\d+/content$'")
 
 	expectedNames := map[string]bool{
 		"tag1": false,
@@ -100,9 +107,9 @@ func TestGetMediaByTag(t *testing.T) {
 	db.FirstOrCreate(&tag3, Tag{Name: "tag3"})
 
 	result := db.Create([]Media{
-		{Name: "media1", URL: "../static/uploads/fgggff5fgf_bg.png", Tags: []*Tag{&tag2}},
-		{Name: "media2", URL: "../static/uploads/fgggttggf_bg.png", Tags: []*Tag{&tag3}},
-		{Name: "media3", URL: "../static/uploads/fgeerggf_bg.png", Tags: []*Tag{&tag3, &tag1}},
+		{Name: "media1", Path: "../static/uploads/fgggff5fgf_bg.png", Tags: []*Tag{&tag2}},
+		{Name: "media2", Path: "../static/uploads/fgggttggf_bg.png", Tags: []*Tag{&tag3}},
+		{Name: "media3", Path: "../static/uploads/fgeerggf_bg.png", Tags: []*Tag{&tag3, &tag1}},
 	})
 	if result.Error != nil {
 		fmt.Printf("Failed to create media: %v\n", result.Error)
@@ -146,7 +153,7 @@ func TestListMedia(t *testing.T) {
 	db.FirstOrCreate(&tag1, Tag{Name: "tag1"})
 
 	result := db.Create([]Media{
-		{Name: "media1", URL: "../static/uploads/fgggff5fgf_bg.png", Tags: []*Tag{&tag1}},
+		{Name: "media1", Path: "../static/uploads/fgggff5fgf_bg.png", Tags: []*Tag{&tag1}},
 	})
 	if result.Error != nil {
 		fmt.Printf("Failed to create media: %v\n", result.Error)
@@ -185,7 +192,7 @@ func TestGetMediaByNonExistantTag(t *testing.T) {
 	db.FirstOrCreate(&tag3, Tag{Name: "tag3"})
 
 	result := db.Create([]Media{
-		{Name: "media1", URL: "../static/uploads/fgggff5fgf_bg.png", Tags: []*Tag{&tag1, &tag2, &tag3}},
+		{Name: "media1", Path: "../static/uploads/fgggff5fgf_bg.png", Tags: []*Tag{&tag1, &tag2, &tag3}},
 	})
 	if result.Error != nil {
 		fmt.Printf("Failed to create media: %v\n", result.Error)
@@ -255,3 +262,515 @@ func TestMediaDefaultHandlerMethod(t *testing.T) {
 	assert.Equal(t, "GET, POST, OPTIONS", allowHeader)
 	assert.Contains(t, recorder.Body.String(), "method not allowed")
 }
+
+func TestGetSingleMedia(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	var tag1 Tag
+	db.FirstOrCreate(&tag1, Tag{Name: "tag1"})
+	media := Media{Name: "media1", Path: "../static/uploads/fgggff5fgf_bg.png", Tags: []*Tag{&tag1}}
+	if result := db.Create(&media); result.Error != nil {
+		t.Fatalf("Failed to create media: %v", result.Error)
+	}
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleMedia(w, r, db)
+	})
+
+	req := httptest.NewRequest("GET", "/v1/media/"+strconv.FormatUint(uint64(media.ID), 10), nil)
+	mux.ServeHTTP(recorder, req)
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var respMedia Media
+	if err := json.Unmarshal(recorder.Body.Bytes(), &respMedia); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Equal(t, "media1", respMedia.Name)
+	assert.Len(t, respMedia.Tags, 1, "Expected tags to be preloaded")
+	assert.Equal(t, "tag1", respMedia.Tags[0].Name)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media/909345", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestPatchMedia(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	var tag1 Tag
+	db.FirstOrCreate(&tag1, Tag{Name: "tag1"})
+	media := Media{Name: "media1", Path: "../static/uploads/fgggff5fgf_bg.png", Tags: []*Tag{&tag1}}
+	if result := db.Create(&media); result.Error != nil {
+		t.Fatalf("Failed to create media: %v", result.Error)
+	}
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleMedia(w, r, db)
+	})
+
+	body := bytes.NewBufferString(`{"name":"renamed","tags":[{"Name":"tag2"},{"Name":"tag3"}]}`)
+	req := httptest.NewRequest(http.MethodPatch, "/v1/media/"+strconv.FormatUint(uint64(media.ID), 10), body)
+	mux.ServeHTTP(recorder, req)
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var stored Media
+	db.Preload("Tags").First(&stored, media.ID)
+	assert.Equal(t, "renamed", stored.Name)
+
+	names := []string{}
+	for _, tag := range stored.Tags {
+		names = append(names, tag.Name)
+	}
+	assert.ElementsMatch(t, []string{"tag2", "tag3"}, names)
+}
+
+func TestDeleteMedia(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	info, err := saveFile(context.Background(), bytes.NewBufferString("content"), "delete_me.txt")
+	if err != nil {
+		t.Fatalf("could not write test file: %v", err)
+	}
+
+	var tag1 Tag
+	db.FirstOrCreate(&tag1, Tag{Name: "tag1"})
+	media := Media{Name: "media1", Path: info.Key, Tags: []*Tag{&tag1}}
+	if result := db.Create(&media); result.Error != nil {
+		t.Fatalf("Failed to create media: %v", result.Error)
+	}
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleMedia(w, r, db)
+	})
+
+	req := httptest.NewRequest(http.MethodDelete, "/v1/media/"+strconv.FormatUint(uint64(media.ID), 10), nil)
+	mux.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	var count int64
+	db.Unscoped().Model(&Media{}).Where("id = ?", media.ID).Count(&count)
+	assert.Equal(t, int64(0), count, "Expected media row to be removed")
+	db.Table("media_tags").Where("media_id = ?", media.ID).Count(&count)
+	assert.Equal(t, int64(0), count, "Expected media_tags links to be removed")
+	_, err = Store.Stat(context.Background(), info.Key)
+	assert.ErrorIs(t, err, storage.ErrNotExist, "Expected file to be removed from storage")
+}
+
+func TestMediaContent(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	file, err := os.Open("../static/tests/bg.png")
+	if err != nil {
+		t.Fatalf("could not open test file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := saveFile(context.Background(), file, generateUniqueFilename("content")+"_bg.png")
+	if err != nil {
+		t.Fatalf("could not write test file: %v", err)
+	}
+	defer removeFile(context.Background(), info.Key)
+
+	media := Media{Name: "media1", Path: info.Key}
+	if result := db.Create(&media); result.Error != nil {
+		t.Fatalf("Failed to create media: %v", result.Error)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media/{id}/content", func(w http.ResponseWriter, r *http.Request) {
+		MediaContent(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", media.URL, nil))
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	expected, _ := os.ReadFile("../static/tests/bg.png")
+	assert.Equal(t, expected, recorder.Body.Bytes())
+	assert.Equal(t, "image/png", recorder.Header().Get("Content-Type"))
+	etag := recorder.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// Range requests return only the requested bytes
+	recorder = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", media.URL, nil)
+	req.Header.Set("Range", "bytes=0-7")
+	mux.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, expected[:8], recorder.Body.Bytes())
+
+	// A matching ETag short-circuits the download
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", media.URL, nil)
+	req.Header.Set("If-None-Match", etag)
+	mux.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+}
+
+// newUploadRequest builds a multipart POST /v1/media request uploading the file at filePath
+func newUploadRequest(t *testing.T, fields map[string]string, filePath string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, value := range fields {
+		_ = writer.WriteField(name, value)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatalf("could not open test file: %v", err)
+	}
+	defer file.Close()
+
+	part, err := writer.CreateFormFile("File", filepath.Base(file.Name()))
+	if err != nil {
+		t.Fatalf("could not create form file: %v", err)
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		t.Fatalf("could not copy file content: %v", err)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/v1/media", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestDuplicateUploadSharesBlob(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+	mux.HandleFunc("/v1/media/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleMedia(w, r, db)
+	})
+
+	var created [2]Media
+	for i, name := range []string{"media1", "media2"} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": name, "Tags": `[]`}, "../static/tests/bg.png"))
+		if status := recorder.Code; status != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &created[i]); err != nil {
+			t.Fatalf("could not unmarshal response body: %v", err)
+		}
+	}
+
+	assert.NotEqual(t, created[0].ID, created[1].ID, "Expected a second media record")
+	assert.Len(t, created[0].SHA256, 64)
+	assert.Equal(t, created[0].SHA256, created[1].SHA256)
+
+	var blob Blob
+	if err := db.Where("sha256 = ?", created[0].SHA256).First(&blob).Error; err != nil {
+		t.Fatalf("could not fetch blob: %v", err)
+	}
+	assert.Equal(t, 2, blob.RefCount, "Expected both media to reference one blob")
+
+	var stored [2]Media
+	db.First(&stored[0], created[0].ID)
+	db.First(&stored[1], created[1].ID)
+	assert.Equal(t, stored[0].Path, stored[1].Path, "Expected both media to point at the same file")
+
+	// removing one media keeps the shared file for the other
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/v1/media/"+strconv.FormatUint(uint64(created[0].ID), 10), nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	_, err := Store.Stat(context.Background(), stored[1].Path)
+	assert.NoError(t, err, "Expected the shared file to remain")
+
+	// removing the last reference removes the file and the blob
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/v1/media/"+strconv.FormatUint(uint64(created[1].ID), 10), nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	_, err = Store.Stat(context.Background(), stored[1].Path)
+	assert.ErrorIs(t, err, storage.ErrNotExist, "Expected the file to be removed with its last media")
+	var count int64
+	db.Model(&Blob{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestDuplicateUploadReusesMedia(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "media1", "Tags": `[{"Name":"tag1"}]`}, "../static/tests/bg.png"))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var first Media
+	json.Unmarshal(recorder.Body.Bytes(), &first)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "media2", "Tags": `[]`, "OnDuplicate": "reuse"}, "../static/tests/bg.png"))
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var reused Media
+	if err := json.Unmarshal(recorder.Body.Bytes(), &reused); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Equal(t, first.ID, reused.ID, "Expected the existing media to be returned")
+	assert.Equal(t, "media1", reused.Name)
+
+	var count int64
+	db.Model(&Media{}).Count(&count)
+	assert.Equal(t, int64(1), count, "Expected no new media record")
+
+	// rejected media aren't reused
+	db.Model(&first).Update("processing_status", processingRejected)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "media2", "Tags": `[]`, "OnDuplicate": "reuse"}, "../static/tests/bg.png"))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	json.Unmarshal(recorder.Body.Bytes(), &reused)
+	assert.NotEqual(t, first.ID, reused.ID, "Expected a new media record next to the rejected one")
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "media3", "Tags": `[]`, "OnDuplicate": "bogus"}, "../static/tests/bg.png"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestCreateMediaIsAllOrNothing(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	// a fresh store makes leftover files easy to spot
+	previous := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previous }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "media1", "Tags": `[{"Name":"ok"}, {"Name":"  "}]`}, "../static/tests/bg.png"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// fail the media insert after the tags have been created inside the transaction
+	fail := func(tx *gorm.DB) {
+		if tx.Statement.Table == "media" {
+			tx.AddError(errors.New("insert failed"))
+		}
+	}
+	if err := db.Callback().Create().Before("gorm:create").Register("test:fail_media", fail); err != nil {
+		t.Fatal(err)
+	}
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "media2", "Tags": `[{"Name":"brand-new"}]`}, "../static/tests/bg.png"))
+	db.Callback().Create().Remove("test:fail_media")
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+
+	var tagCount, blobCount int64
+	db.Model(&Tag{}).Count(&tagCount)
+	db.Model(&Blob{}).Count(&blobCount)
+	assert.Zero(t, tagCount, "Expected the tag created before the failure to be rolled back")
+	assert.Zero(t, blobCount)
+	files, err := Store.List(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Empty(t, files, "Expected no file to be left behind")
+}
+
+func TestConcurrentUploadsShareTags(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+
+	const uploads = 24
+	requests := make([]*http.Request, uploads)
+	for i := range requests {
+		tags := fmt.Sprintf(`[{"Name":"shared"}, {"Name":"Also Shared"}, {"Name":"group-%d"}]`, i%3)
+		requests[i] = newUploadRequest(t, map[string]string{"Name": fmt.Sprintf("media%d", i), "Tags": tags}, "../static/tests/bg.png")
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, uploads)
+	start := make(chan struct{})
+	for i, req := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, req)
+			codes[i] = recorder.Code
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	for i, code := range codes {
+		assert.Equal(t, http.StatusCreated, code, "upload %d", i)
+	}
+
+	var tags []Tag
+	db.Order("name").Find(&tags)
+	assert.Equal(t, []string{"also shared", "group-0", "group-1", "group-2", "shared"}, tagNames(tags), "Expected every tag to be created once")
+	for _, tag := range tags {
+		var links int64
+		db.Table("media_tags").Where("tag_id = ?", tag.ID).Count(&links)
+		assert.Equal(t, links, tag.UsageCount, tag.Name)
+	}
+}
+
+func TestReceiveUploadTooLarge(t *testing.T) {
+	previous, previousSize := Store, MaxUploadSize
+	Store = storage.NewLocal(t.TempDir())
+	MaxUploadSize = 1024
+	defer func() { Store, MaxUploadSize = previous, previousSize }()
+
+	recorder := httptest.NewRecorder()
+	_, ok := receiveUpload(recorder, newUploadRequest(t, map[string]string{"Name": "big", "Tags": `[]`}, "../static/tests/bg.png"))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+	files, err := Store.List(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Empty(t, files, "Expected the partial file to be removed")
+}
+
+func TestReceiveUpload(t *testing.T) {
+	previous := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previous }()
+
+	recorder := httptest.NewRecorder()
+	upload, ok := receiveUpload(recorder, newUploadRequest(t, map[string]string{"Name": "media1", "Tags": `[{"Name":"cat"}]`}, "../static/tests/bg.png"))
+	if !ok {
+		t.Fatalf("upload failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	data, _ := os.ReadFile("../static/tests/bg.png")
+	sum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), upload.sha256)
+	assert.Equal(t, "image/png", upload.contentType)
+	assert.Equal(t, "bg.png", upload.filename)
+	assert.Equal(t, int64(len(data)), upload.info.Size)
+	assert.Equal(t, "new", upload.onDuplicate)
+	assert.Equal(t, "cat", upload.tags[0].Name)
+
+	// invalid tags are rejected and nothing is kept
+	Store = storage.NewLocal(t.TempDir())
+	recorder = httptest.NewRecorder()
+	_, ok = receiveUpload(recorder, newUploadRequest(t, map[string]string{"Name": "media1", "Tags": `{`}, "../static/tests/bg.png"))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	files, _ := Store.List(context.Background(), "")
+	assert.Empty(t, files)
+}
+
+func TestHashingReader(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	content := newHashingReader(bytes.NewReader(data), nil)
+	if _, err := io.Copy(io.Discard, content); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), content.sum())
+	assert.Equal(t, data[:sniffLen], content.head)
+	assert.NoError(t, content.err)
+
+	// the check runs once the head is sniffed and stops the copy
+	refused := errors.New("refused")
+	checked := ""
+	content = newHashingReader(bytes.NewReader(data), func(contentType string) error {
+		checked = contentType
+		return refused
+	})
+	_, err := io.Copy(io.Discard, content)
+	assert.ErrorIs(t, err, refused)
+	assert.ErrorIs(t, content.err, refused)
+	assert.Equal(t, "text/plain; charset=utf-8", checked)
+}
+
+func TestDetectContentType(t *testing.T) {
+	for head, want := range map[string]string{
+		"\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00qt  ":             "video/quicktime",
+		"\x00\x00\x00\x18ftypM4V \x00\x00\x00\x01isomqt  ":         "video/quicktime",
+		"\x00\x00\x00\x08wide\x00\x00\x00\x00mdat":                 "video/quicktime",
+		"\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isommp41":         "video/mp4",
+		"\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska": "video/x-matroska",
+		"\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm":     "video/webm",
+		"\x00\x00\x00\x14ftypqt":                                   "application/octet-stream",
+		"\x1a\x45\xdf\xa3 something else":                          "video/webm",
+	} {
+		assert.Equal(t, want, detectContentType([]byte(head)), "%q", head)
+	}
+	assert.True(t, contentTypeAllowed("video/quicktime"))
+	assert.NoError(t, checkContentType("video/quicktime", "clip.mov"))
+	assert.NoError(t, checkContentType("video/x-matroska", "clip.mkv"))
+}
+
+func TestCheckContentType(t *testing.T) {
+	assert.NoError(t, checkContentType("image/png", "bg.png"))
+	assert.NoError(t, checkContentType("image/jpeg", "photo.JPG"))
+	assert.NoError(t, checkContentType("application/pdf", "report.pdf"))
+	assert.NoError(t, checkContentType("image/png", "no-extension"))
+
+	var typeErr *contentTypeError
+	if assert.ErrorAs(t, checkContentType("text/plain; charset=utf-8", "notes.txt"), &typeErr) {
+		assert.Equal(t, http.StatusUnsupportedMediaType, typeErr.Status)
+	}
+	if assert.ErrorAs(t, checkContentType("application/pdf", "bg.png"), &typeErr) {
+		assert.Equal(t, http.StatusBadRequest, typeErr.Status)
+	}
+
+	previous := AllowedContentTypes
+	AllowedContentTypes = []string{"image/png"}
+	defer func() { AllowedContentTypes = previous }()
+	assert.NoError(t, checkContentType("image/png", "bg.png"))
+	assert.Error(t, checkContentType("image/gif", "anim.gif"))
+}
+
+func TestReceiveUploadRefusesContent(t *testing.T) {
+	previous := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previous }()
+
+	dir := t.TempDir()
+	notes := filepath.Join(dir, "notes.txt")
+	os.WriteFile(notes, []byte("just some text"), 0o600)
+	png, _ := os.ReadFile("../static/tests/bg.png")
+	disguised := filepath.Join(dir, "bg.pdf")
+	os.WriteFile(disguised, png, 0o600)
+
+	for path, code := range map[string]int{notes: http.StatusUnsupportedMediaType, disguised: http.StatusBadRequest} {
+		recorder := httptest.NewRecorder()
+		_, ok := receiveUpload(recorder, newUploadRequest(t, map[string]string{"Name": "media1", "Tags": `[]`}, path))
+		assert.False(t, ok, path)
+		assert.Equal(t, code, recorder.Code, path)
+	}
+	files, _ := Store.List(context.Background(), "")
+	assert.Empty(t, files, "Expected refused files to be removed")
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errMergeSourceMissing is returned when a merge source tag doesn't exist
+var errMergeSourceMissing = errors.New("Source tag not found")
+
+// mergeResult - outcome of merging tags into a target
+type mergeResult struct {
+	Tag           Tag    `json:"tag"`
+	Merged        []uint `json:"merged"`
+	Aliased       bool   `json:"aliased"`
+	MediaAffected int64  `json:"media_affected"`
+}
+
+// MergeTags - folds the source tags into the target tag addressed by ID or name
+func MergeTags(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	idOrName := r.PathValue("id")
+	if idOrName == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var target Tag
+		if !loadTag(w, db, idOrName, &target) {
+			return
+		}
+
+		var input struct {
+			Sources []uint `json:"sources"`
+			// Alias keeps the source names working as aliases of the target, the default
+			Alias *bool `json:"alias"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		if len(input.Sources) == 0 {
+			http.Error(w, "Sources are required", http.StatusBadRequest)
+			return
+		}
+		for _, id := range input.Sources {
+			if id == target.ID {
+				http.Error(w, "A tag can't be merged into itself", http.StatusBadRequest)
+				return
+			}
+		}
+		result := mergeResult{Aliased: input.Alias == nil || *input.Alias}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var sources []Tag
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Find(&sources, input.Sources).Error; err != nil {
+				return err
+			}
+			if len(sources) != len(uniqueIDs(input.Sources)) {
+				return errMergeSourceMissing
+			}
+			for _, source := range sources {
+				result.Merged = append(result.Merged, source.ID)
+			}
+
+			// the sources' children move under the target, which mustn't sit below a source
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", hierarchyLockKey).Error; err != nil {
+				return err
+			}
+			ancestors, err := ancestorIDs(tx, target.ID)
+			if err != nil {
+				return err
+			}
+			for _, id := range ancestors {
+				for _, source := range result.Merged {
+					if id == source {
+						return errTagCycle
+					}
+				}
+			}
+			if err := tx.Model(&Tag{}).Where("parent_id IN ?", result.Merged).Update("parent_id", target.ID).Error; err != nil {
+				return err
+			}
+
+			// every media carrying a source tag ends up carrying the target instead
+			if err := tx.Raw("SELECT COUNT(DISTINCT media_id) FROM media_tags WHERE tag_id IN ?", result.Merged).
+				Scan(&result.MediaAffected).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec(`INSERT INTO media_tags (media_id, tag_id)
+				SELECT DISTINCT media_id, ? FROM media_tags WHERE tag_id IN ?
+				ON CONFLICT DO NOTHING`, target.ID, result.Merged).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("DELETE FROM media_tags WHERE tag_id IN ?", result.Merged).Error; err != nil {
+				return err
+			}
+			if err := recountUsage(tx, target.ID); err != nil {
+				return err
+			}
+
+			// aliases of the sources now lead to the target
+			if err := tx.Model(&TagAlias{}).Where("tag_id IN ?", result.Merged).Update("tag_id", target.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Delete(&Tag{}, result.Merged).Error; err != nil {
+				return err
+			}
+			if !result.Aliased {
+				return nil
+			}
+			for _, source := range sources {
+				alias := TagAlias{Name: source.qualifiedName(), DisplayName: source.DisplayName, TagID: target.ID}
+				if err := tx.Create(&alias).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, errMergeSourceMissing) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errTagCycle) {
+			http.Error(w, "Target tag is a descendant of a source tag", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to merge tags", http.StatusInternalServerError)
+			return
+		}
+		// the merge changed the target's count, what is returned is the tag as it now stands
+		if err := db.First(&result.Tag, target.ID).Error; err != nil {
+			http.Error(w, "Failed to fetch tag", http.StatusInternalServerError)
+			return
+		}
+		if wantsCounts(r) {
+			count := result.Tag.UsageCount
+			result.Tag.MediaCount = &count
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			http.Error(w, "Failed to encode merge result", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uniqueIDs drops repeated IDs, keeping the first occurrence
+func uniqueIDs(ids []uint) []uint {
+	seen := map[uint]bool{}
+	var unique []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
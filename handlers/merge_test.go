@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeTags(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	target := Tag{Name: "new-york"}
+	nyc := Tag{Name: "nyc"}
+	bigApple := Tag{Name: "big apple"}
+	db.Create(&target)
+	db.Create(&nyc)
+	db.Create(&bigApple)
+	db.Create(&TagAlias{Name: "ny", TagID: nyc.ID})
+
+	media1 := Media{Name: "media1", Tags: []*Tag{&target, &nyc}}
+	media2 := Media{Name: "media2", Tags: []*Tag{&nyc, &bigApple}}
+	media3 := Media{Name: "media3", Tags: []*Tag{&target}}
+	db.Create(&media1)
+	db.Create(&media2)
+	db.Create(&media3)
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/{id}/merge", func(w http.ResponseWriter, r *http.Request) {
+		MergeTags(w, r, db)
+	})
+	body := fmt.Sprintf(`{"sources":[%d,%d]}`, nyc.ID, bigApple.ID)
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", fmt.Sprintf("/v1/tags/%d/merge?counts=true", target.ID), bytes.NewBufferString(body)))
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var result mergeResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Equal(t, int64(2), result.MediaAffected)
+	assert.ElementsMatch(t, []uint{nyc.ID, bigApple.ID}, result.Merged)
+	assert.Equal(t, target.ID, result.Tag.ID)
+	if assert.NotNil(t, result.Tag.MediaCount) {
+		assert.Equal(t, int64(3), *result.Tag.MediaCount, "Expected the target as it is after the merge")
+	}
+
+	// each media carries the target exactly once
+	for _, media := range []Media{media1, media2, media3} {
+		var stored Media
+		db.Preload("Tags").First(&stored, media.ID)
+		assert.Len(t, stored.Tags, 1, media.Name)
+		assert.Equal(t, target.ID, stored.Tags[0].ID, media.Name)
+	}
+
+	var count int64
+	db.Model(&Tag{}).Where("id IN ?", []uint{nyc.ID, bigApple.ID}).Count(&count)
+	assert.Equal(t, int64(0), count, "Expected the sources to be deleted")
+
+	// the source names and their aliases now lead to the target
+	var aliases []TagAlias
+	db.Order("name").Find(&aliases)
+	names := []string{}
+	for _, alias := range aliases {
+		names = append(names, alias.Name)
+		assert.Equal(t, target.ID, alias.TagID)
+	}
+	assert.Equal(t, []string{"big apple", "ny", "nyc"}, names)
+}
+
+func TestMergeTagsWithoutAliases(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	target := Tag{Name: "cat"}
+	source := Tag{Name: "kitty"}
+	db.Create(&target)
+	db.Create(&source)
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/{id}/merge", func(w http.ResponseWriter, r *http.Request) {
+		MergeTags(w, r, db)
+	})
+	body := fmt.Sprintf(`{"sources":[%d],"alias":false}`, source.ID)
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/tags/cat/merge", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var count int64
+	db.Model(&TagAlias{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestMergeTagsInvalid(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	target := Tag{Name: "cat"}
+	db.Create(&target)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/{id}/merge", func(w http.ResponseWriter, r *http.Request) {
+		MergeTags(w, r, db)
+	})
+
+	cases := map[string]int{
+		`{"sources":[]}`: http.StatusBadRequest,
+		fmt.Sprintf(`{"sources":[%d]}`, target.ID): http.StatusBadRequest,
+		`{"sources":[909345]}`:                     http.StatusNotFound,
+	}
+	for body, status := range cases {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/tags/cat/merge", bytes.NewBufferString(body)))
+		assert.Equal(t, status, recorder.Code, body)
+	}
+
+	var count int64
+	db.Model(&Tag{}).Count(&count)
+	assert.Equal(t, int64(1), count, "Expected a failed merge to change nothing")
+}
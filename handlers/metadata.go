@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// maxPDFScan caps how much of a PDF is searched for its pages
+const maxPDFScan = 64 << 20
+
+// MediaMetadata - what the extractors learned about the content of a media item, kept as JSONB
+type MediaMetadata struct {
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Pages is the page count of documents
+	Pages int `json:"pages,omitempty"`
+	// Duration of audio and video in seconds
+	Duration float64 `json:"duration,omitempty"`
+	// Camera, TakenAt and GPS come from the EXIF data of photos
+	Camera  string       `json:"camera,omitempty"`
+	TakenAt *time.Time   `json:"taken_at,omitempty"`
+	GPS     *GPSPosition `json:"gps,omitempty"`
+}
+
+// GPSPosition - where a photo was taken, in signed degrees
+type GPSPosition struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Value stores the metadata as a JSON object
+func (m MediaMetadata) Value() (driver.Value, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan reads the metadata back from its JSON object
+func (m *MediaMetadata) Scan(src any) error {
+	*m = MediaMetadata{}
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(src, m)
+	case string:
+		return json.Unmarshal([]byte(src), m)
+	default:
+		return fmt.Errorf("cannot scan %T into MediaMetadata", src)
+	}
+}
+
+// metadataExtractor - reads some metadata from content, a failure leaves the rest of the pipeline running
+type metadataExtractor func(r io.ReadSeeker, metadata *MediaMetadata) error
+
+// metadataExtractors run in order for each content type
+var metadataExtractors = map[string][]metadataExtractor{
+	"image/jpeg":      {readDimensions, readExif},
+	"image/png":       {readDimensions},
+	"image/gif":       {readDimensions},
+	"application/pdf": {readPDFPages},
+	"video/mp4":       {readMP4Duration},
+	"video/quicktime": {readMP4Duration},
+}
+
+// extractMetadata runs the extractors for the content type over a stored file. Content that can't be
+// parsed is logged and leaves the fields it would have filled empty, only failing to read the file
+// is an error.
+func extractMetadata(ctx context.Context, key, contentType string) (MediaMetadata, error) {
+	var metadata MediaMetadata
+	extractors := metadataExtractors[baseMediaType(contentType)]
+	if len(extractors) == 0 {
+		return metadata, nil
+	}
+	file, err := Store.Get(ctx, key)
+	if err != nil {
+		return metadata, err
+	}
+	defer file.Close()
+	for _, extract := range extractors {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return metadata, err
+		}
+		if err := extract(file, &metadata); err != nil && !errors.Is(err, errNoExif) {
+			log.Printf("failed to extract metadata from %q: %v", key, err)
+		}
+	}
+	return metadata, nil
+}
+
+// readDimensions reads the width and height from the image header
+func readDimensions(r io.ReadSeeker, metadata *MediaMetadata) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	metadata.Width, metadata.Height = config.Width, config.Height
+	return nil
+}
+
+var (
+	// pdfPageObject matches page objects, not the /Pages nodes above them
+	pdfPageObject = regexp.MustCompile(`/Type\s*/Page(?:[^A-Za-z]|$)`)
+	pdfPageCount  = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+)
+
+// readPDFPages counts the page objects of a PDF. Compressed object streams hide them, then the
+// largest /Count of a page tree node, which is the root's, stands in.
+func readPDFPages(r io.ReadSeeker, metadata *MediaMetadata) error {
+	data, err := io.ReadAll(io.LimitReader(r, maxPDFScan))
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return errors.New("not a PDF")
+	}
+	pages := len(pdfPageObject.FindAllIndex(data, -1))
+	if pages == 0 {
+		for _, match := range pdfPageCount.FindAllSubmatch(data, -1) {
+			count := match[1]
+			if len(count) == 0 {
+				count = match[2]
+			}
+			if n, err := strconv.Atoi(string(count)); err == nil && n > pages {
+				pages = n
+			}
+		}
+	}
+	metadata.Pages = pages
+	return nil
+}
+
+// readMP4Duration reads the duration from the movie header box of an MP4
+func readMP4Duration(r io.ReadSeeker, metadata *MediaMetadata) error {
+	moov, err := findMP4Box(r, "moov", -1)
+	if err != nil {
+		return err
+	}
+	mvhd, err := findMP4Box(r, "mvhd", moov)
+	if err != nil {
+		return err
+	}
+	if mvhd < 20 {
+		return errors.New("invalid mvhd box")
+	}
+	header := make([]byte, min(mvhd, 32))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	var timescale uint32
+	var duration uint64
+	switch {
+	case header[0] == 1 && len(header) >= 32:
+		timescale = binary.BigEndian.Uint32(header[20:])
+		duration = binary.BigEndian.Uint64(header[24:])
+	case header[0] == 0 && len(header) >= 20:
+		timescale = binary.BigEndian.Uint32(header[12:])
+		duration = uint64(binary.BigEndian.Uint32(header[16:]))
+	default:
+		return errors.New("invalid mvhd box")
+	}
+	if timescale == 0 {
+		return errors.New("invalid mvhd timescale")
+	}
+	metadata.Duration = math.Round(float64(duration)/float64(timescale)*1000) / 1000
+	return nil
+}
+
+// findMP4Box walks the boxes from the current position until one of the given type, within limit
+// bytes or to the end with a negative limit. It leaves r at the start of the box's payload and
+// returns the payload size.
+func findMP4Box(r io.ReadSeeker, boxType string, limit int64) (int64, error) {
+	bounded := limit >= 0
+	for !bounded || limit >= 8 {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, fmt.Errorf("no %s box", boxType)
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header[:4])), int64(8)
+		switch size {
+		case 0:
+			// the box runs to the end of the file
+			current, err := r.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return 0, err
+			}
+			end, err := r.Seek(0, io.SeekEnd)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := r.Seek(current, io.SeekStart); err != nil {
+				return 0, err
+			}
+			size = end - current + headerSize
+		case 1:
+			var large [8]byte
+			if _, err := io.ReadFull(r, large[:]); err != nil {
+				return 0, err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(large[:])), 16
+		}
+		if size < headerSize || (bounded && size > limit) {
+			return 0, errors.New("invalid MP4 box size")
+		}
+		if string(header[4:]) == boxType {
+			return size - headerSize, nil
+		}
+		if _, err := r.Seek(size-headerSize, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		limit -= size
+	}
+	return 0, fmt.Errorf("no %s box", boxType)
+}
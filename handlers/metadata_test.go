@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bee-keeper/tags-api/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// tiffField - field of a test IFD, pointing at another IFD of the test structure when ifd is set
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+	ifd   int // 1-based index of the IFD pointed at
+}
+
+func asciiField(tag uint16, s string) tiffField {
+	return tiffField{tag: tag, typ: tiffASCII, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+func rationalField(tag uint16, values ...uint32) tiffField {
+	data := make([]byte, 0, len(values)*8)
+	for _, v := range values {
+		data = binary.LittleEndian.AppendUint32(data, v)
+		data = binary.LittleEndian.AppendUint32(data, 1)
+	}
+	return tiffField{tag: tag, typ: tiffRational, count: uint32(len(values)), data: data}
+}
+
+// buildTIFF lays out little endian IFDs one after the other, followed by the values that don't fit inline
+func buildTIFF(ifds ...[]tiffField) []byte {
+	offsets := make([]uint32, len(ifds))
+	next := uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = next
+		next += 2 + 12*uint32(len(ifd)) + 4
+	}
+	out := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	var extra []byte
+	for _, ifd := range ifds {
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(ifd)))
+		for _, f := range ifd {
+			out = binary.LittleEndian.AppendUint16(out, f.tag)
+			if f.ifd > 0 {
+				out = binary.LittleEndian.AppendUint16(out, tiffLong)
+				out = binary.LittleEndian.AppendUint32(out, 1)
+				out = binary.LittleEndian.AppendUint32(out, offsets[f.ifd-1])
+				continue
+			}
+			out = binary.LittleEndian.AppendUint16(out, f.typ)
+			out = binary.LittleEndian.AppendUint32(out, f.count)
+			if len(f.data) <= 4 {
+				out = append(out, append(f.data, make([]byte, 4-len(f.data))...)...)
+			} else {
+				out = binary.LittleEndian.AppendUint32(out, next+uint32(len(extra)))
+				extra = append(extra, f.data...)
+			}
+		}
+		out = binary.LittleEndian.AppendUint32(out, 0)
+	}
+	return append(out, extra...)
+}
+
+// jpegWithExif wraps TIFF data in the APP1 segment of an otherwise empty JPEG
+func jpegWithExif(tiff []byte) []byte {
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	out := []byte{0xff, 0xd8, 0xff, 0xe0, 0, 4, 0, 0, 0xff, 0xe1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, 0xff, 0xda, 0, 2)
+}
+
+func TestReadExif(t *testing.T) {
+	data := jpegWithExif(buildTIFF(
+		[]tiffField{
+			asciiField(exifMake, "Canon"),
+			asciiField(exifModel, "Canon EOS R5"),
+			asciiField(exifDateTime, "2024:06:01 00:00:00"),
+			{tag: exifIFDPointer, ifd: 2},
+			{tag: exifGPSPointer, ifd: 3},
+		},
+		[]tiffField{
+			asciiField(exifDateTimeOriginal, "2024:05:01 10:30:00"),
+			asciiField(exifOffsetOriginal, "+02:00"),
+		},
+		[]tiffField{
+			asciiField(gpsLatitudeRef, "N"),
+			rationalField(gpsLatitude, 48, 51, 36),
+			asciiField(gpsLongitudeRef, "W"),
+			rationalField(gpsLongitude, 2, 17, 24),
+		},
+	))
+
+	var metadata MediaMetadata
+	if err := readExif(bytes.NewReader(data), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Canon EOS R5", metadata.Camera)
+	if assert.NotNil(t, metadata.TakenAt) {
+		assert.True(t, time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC).Equal(*metadata.TakenAt), metadata.TakenAt.String())
+	}
+	assert.Equal(t, &GPSPosition{Latitude: 48.86, Longitude: -2.29}, metadata.GPS)
+
+	// a JPEG without EXIF isn't an error worth reporting
+	err := readExif(bytes.NewReader([]byte{0xff, 0xd8, 0xff, 0xda, 0, 2}), &metadata)
+	assert.ErrorIs(t, err, errNoExif)
+}
+
+func TestReadPDFPages(t *testing.T) {
+	pdf := "%PDF-1.4\n1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+		"2 0 obj << /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >> endobj\n" +
+		"3 0 obj << /Type /Page /Parent 2 0 R >> endobj\n" +
+		"4 0 obj << /Type/Page/Parent 2 0 R >> endobj\n%%EOF"
+	var metadata MediaMetadata
+	assert.NoError(t, readPDFPages(bytes.NewReader([]byte(pdf)), &metadata))
+	assert.Equal(t, 2, metadata.Pages)
+
+	// page objects hidden in object streams leave the page tree count
+	compressed := "%PDF-1.5\n2 0 obj << /Count 7 /Kids [5 0 R] /Type /Pages >> endobj\n%%EOF"
+	metadata = MediaMetadata{}
+	assert.NoError(t, readPDFPages(bytes.NewReader([]byte(compressed)), &metadata))
+	assert.Equal(t, 7, metadata.Pages)
+
+	assert.Error(t, readPDFPages(bytes.NewReader([]byte("not a pdf")), &metadata))
+}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(out, boxType...), body...)
+}
+
+func TestReadMP4Duration(t *testing.T) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)  // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 12345) // duration
+	data := append(mp4Box("ftyp", []byte("isom\x00\x00\x02\x00")), mp4Box("moov", mp4Box("trak"), mp4Box("mvhd", mvhd))...)
+
+	var metadata MediaMetadata
+	assert.NoError(t, readMP4Duration(bytes.NewReader(data), &metadata))
+	assert.Equal(t, 12.345, metadata.Duration)
+
+	assert.Error(t, readMP4Duration(bytes.NewReader(mp4Box("ftyp", []byte("isom"))), &metadata))
+}
+
+func TestMediaMetadataValueScan(t *testing.T) {
+	taken := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	metadata := MediaMetadata{Width: 640, Height: 480, TakenAt: &taken}
+	value, err := metadata.Value()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"width":640,"height":480,"taken_at":"2024-05-01T10:30:00Z"}`, value.(string))
+
+	var scanned MediaMetadata
+	assert.NoError(t, scanned.Scan([]byte(value.(string))))
+	assert.Equal(t, metadata.Width, scanned.Width)
+	assert.True(t, taken.Equal(*scanned.TakenAt))
+	assert.NoError(t, scanned.Scan(nil))
+	assert.Equal(t, MediaMetadata{}, scanned)
+	assert.Error(t, scanned.Scan(42))
+}
+
+func TestExtractMetadata(t *testing.T) {
+	previous := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previous }()
+
+	data, err := os.ReadFile("../static/tests/bg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, _ := image.DecodeConfig(bytes.NewReader(data))
+	info, err := saveFile(context.Background(), bytes.NewReader(data), "bg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := extractMetadata(context.Background(), info.Key, "image/png")
+	assert.NoError(t, err)
+	assert.Equal(t, config.Width, metadata.Width)
+	assert.Equal(t, config.Height, metadata.Height)
+
+	// content without extractors or that fails to parse leaves the metadata empty
+	for _, contentType := range []string{"audio/mpeg", "application/pdf"} {
+		metadata, err := extractMetadata(context.Background(), info.Key, contentType)
+		assert.NoError(t, err)
+		assert.Equal(t, MediaMetadata{}, metadata)
+	}
+	_, err = extractMetadata(context.Background(), "missing.png", "image/png")
+	assert.Error(t, err)
+}
+
+func TestParseMetadataFilter(t *testing.T) {
+	f, err := parseMediaFilter(url.Values{"width_gte": {"1000"}, "taken_after": {"2024-01-01"}})
+	assert.NoError(t, err)
+	assert.Len(t, f.metadata, 2)
+
+	for _, invalid := range []url.Values{{"width_gte": {"wide"}}, {"height_lte": {"-1"}}, {"taken_before": {"yesterday"}}} {
+		_, err := parseMediaFilter(invalid)
+		assert.Error(t, err, invalid.Encode())
+	}
+}
+
+func TestFilterMediaByMetadata(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	early := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	late := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	db.Create(&Media{Name: "small", Metadata: MediaMetadata{Width: 640, Height: 480, TakenAt: &early}})
+	db.Create(&Media{Name: "large", Metadata: MediaMetadata{Width: 4000, Height: 3000, TakenAt: &late}})
+	db.Create(&Media{Name: "document", Metadata: MediaMetadata{Pages: 3}})
+
+	tests := []struct {
+		query string
+		names []string
+	}{
+		{"width_gte=1000", []string{"large"}},
+		{"width_lte=1000&height_gte=100", []string{"small"}},
+		{"taken_after=2024-01-01", []string{"large"}},
+		{"taken_before=2024-01-01", []string{"small"}},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		AllMedia(recorder, httptest.NewRequest("GET", "/v1/media?"+test.query, nil), db)
+		if status := recorder.Code; status != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", test.query, status, http.StatusOK)
+		}
+		var medias []Media
+		if err := json.Unmarshal(recorder.Body.Bytes(), &medias); err != nil {
+			t.Fatalf("could not unmarshal response body: %v", err)
+		}
+		var names []string
+		for _, media := range medias {
+			names = append(names, media.Name)
+		}
+		assert.Equal(t, test.names, names, test.query)
+	}
+
+	recorder := httptest.NewRecorder()
+	AllMedia(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/media?width_gte=%s", "wide"), nil), db)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bee-keeper/tags-api/jobs"
+	"gorm.io/gorm"
+)
+
+// Migrate brings the database schema in line with the models
+func Migrate(db *gorm.DB) error {
+	countUsage := !db.Migrator().HasColumn(&Tag{}, "usage_count")
+	if err := db.AutoMigrate(&Tag{}, &Media{}, &Blob{}, &TagAlias{}, &Upload{}, &UploadPart{}, &TagRule{}, &jobs.Job{}); err != nil {
+		return err
+	}
+
+	// Usage counts are kept up to date from here on, tags that existed before start from a full count
+	if countUsage {
+		if err := recountUsage(db); err != nil {
+			return err
+		}
+	}
+
+	// Tag names are rewritten together, a failure leaves them as they were
+	if err := db.Transaction(normalizeTagNames); err != nil {
+		return err
+	}
+
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_tag_aliases_name_ci ON tag_aliases (lower(name))").Error; err != nil {
+		return err
+	}
+
+	// Search keys of rows saved before suggestions existed, the hooks keep them current afterwards
+	var unkeyedTags []Tag
+	if err := db.Where("search_key = ''").FindInBatches(&unkeyedTags, 500, func(tx *gorm.DB, _ int) error {
+		for _, tag := range unkeyedTags {
+			if err := tx.Model(&tag).UpdateColumn("search_key", searchKey(tag.Name)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error; err != nil {
+		return err
+	}
+	var unkeyedAliases []TagAlias
+	if err := db.Where("search_key = ''").FindInBatches(&unkeyedAliases, 500, func(tx *gorm.DB, _ int) error {
+		for _, alias := range unkeyedAliases {
+			_, name := splitTagName(alias.Name)
+			if err := tx.Model(&alias).UpdateColumn("search_key", searchKey(name)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error; err != nil {
+		return err
+	}
+	// text_pattern_ops lets LIKE 'prefix%' use the index whatever the database collation
+	for _, index := range []string{
+		"CREATE INDEX IF NOT EXISTS idx_tags_search_key ON tags (search_key text_pattern_ops)",
+		"CREATE INDEX IF NOT EXISTS idx_tags_name_prefix ON tags (name text_pattern_ops)",
+		"CREATE INDEX IF NOT EXISTS idx_tag_aliases_search_key ON tag_aliases (search_key text_pattern_ops)",
+	} {
+		if err := db.Exec(index).Error; err != nil {
+			return err
+		}
+	}
+
+	// media_tags is keyed by (media_id, tag_id), tag filters also need to go from tag to media
+	if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_media_tags_tag_id ON media_tags (tag_id, media_id)").Error; err != nil {
+		return err
+	}
+
+	// Media created before the content endpoint kept the file path in the url column
+	if db.Migrator().HasColumn(&Media{}, "url") {
+		if err := db.Exec("UPDATE media SET path = url WHERE path IS NULL OR path = ''").Error; err != nil {
+			return err
+		}
+	}
+
+	// Paths used to include the upload directory, storage keys are relative to the backend root,
+	// which is that directory by default
+	if err := db.Exec("UPDATE media SET path = regexp_replace(path, '^.*/', '') WHERE path LIKE '../static/uploads/%'").Error; err != nil {
+		return err
+	}
+
+	// Media uploaded before sizes were recorded take the size of their blob
+	if err := db.Exec("UPDATE media SET size = blobs.size FROM blobs WHERE media.sha256 = blobs.sha256 AND media.size IS NULL").Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// normalizeTagNames brings the names of tags created before normalization and namespaces in line,
+// merging the tags that turn out to differ only in case, and has the database enforce unique names
+func normalizeTagNames(tx *gorm.DB) error {
+	// Names are unique per namespace now, "paris" the person and "paris" the place can both exist
+	if err := tx.Exec("DROP INDEX IF EXISTS idx_tags_name_ci").Error; err != nil {
+		return err
+	}
+
+	// Tags created before normalization keep their spelling as the display name
+	var legacyTags []Tag
+	if err := tx.Where("display_name IS NULL OR display_name = ''").Find(&legacyTags).Error; err != nil {
+		return err
+	}
+	for _, tag := range legacyTags {
+		if err := tag.normalize(); err != nil {
+			log.Printf("leaving tag %d %q as it is: %v", tag.ID, tag.Name, err)
+			continue
+		}
+		if err := tx.Model(&tag).Updates(map[string]any{"name": tag.Name, "display_name": tag.DisplayName}).Error; err != nil {
+			return fmt.Errorf("normalizing tag %d: %w", tag.ID, err)
+		}
+	}
+	// Tags named "namespace:name" before namespaces existed move into that namespace
+	if err := tx.Exec(`UPDATE tags SET namespace = btrim(split_part(name, ':', 1)), name = btrim(substr(name, strpos(name, ':') + 1))
+		WHERE namespace = '' AND strpos(name, ':') > 1 AND btrim(split_part(name, ':', 1)) <> '' AND btrim(substr(name, strpos(name, ':') + 1)) <> ''`).Error; err != nil {
+		return fmt.Errorf("moving tags into namespaces: %w", err)
+	}
+
+	if err := mergeCaseDuplicates(tx); err != nil {
+		return fmt.Errorf("merging tags that differ only in case: %w", err)
+	}
+	// Normalized names are already case folded, the index makes the database enforce it too
+	if err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_tags_namespace_name_ci ON tags (namespace, lower(name))").Error; err != nil {
+		return fmt.Errorf("creating case-insensitive tag name index: %w", err)
+	}
+	return nil
+}
+
+// mergeCaseDuplicates folds tags whose names differ only in case into the oldest live one of them,
+// which takes over their media, children and aliases
+func mergeCaseDuplicates(tx *gorm.DB) error {
+	var duplicates []struct {
+		ID     uint
+		KeepID uint
+	}
+	if err := tx.Raw(`SELECT id, keep_id FROM (
+			SELECT id, first_value(id) OVER (PARTITION BY namespace, lower(name) ORDER BY deleted_at IS NOT NULL, id) AS keep_id
+			FROM tags
+		) grouped WHERE id <> keep_id ORDER BY id`).Scan(&duplicates).Error; err != nil {
+		return err
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	kept := make([]uint, 0, len(duplicates))
+	for _, d := range duplicates {
+		if err := tx.Exec(`INSERT INTO media_tags (media_id, tag_id) SELECT media_id, ? FROM media_tags WHERE tag_id = ?
+			ON CONFLICT DO NOTHING`, d.KeepID, d.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM media_tags WHERE tag_id = ?", d.ID).Error; err != nil {
+			return err
+		}
+		// a kept tag that sat below its duplicate moves to the top level rather than below itself
+		if err := tx.Exec("UPDATE tags SET parent_id = NULL WHERE id = ? AND parent_id = ?", d.KeepID, d.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("UPDATE tags SET parent_id = ? WHERE parent_id = ?", d.KeepID, d.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("UPDATE tag_aliases SET tag_id = ? WHERE tag_id = ?", d.KeepID, d.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM tags WHERE id = ?", d.ID).Error; err != nil {
+			return err
+		}
+		kept = append(kept, d.KeepID)
+	}
+	log.Printf("merged %d tags that differ only in case", len(duplicates))
+	return recountUsage(tx, uniqueIDs(kept)...)
+}
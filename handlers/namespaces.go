@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+// namespaceCount - a tag namespace with the number of tags in it, "" is the default namespace
+type namespaceCount struct {
+	Namespace string `json:"namespace"`
+	TagCount  int64  `json:"tag_count"`
+}
+
+// Namespaces - lists the tag namespaces in use with their tag counts
+func Namespaces(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.URL.Path != "/v1/namespaces" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		namespaces := []namespaceCount{}
+		if err := db.Model(&Tag{}).Select("namespace, COUNT(*) AS tag_count").
+			Group("namespace").Order("namespace").Scan(&namespaces).Error; err != nil {
+			http.Error(w, "Failed to fetch namespaces", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(namespaces); err != nil {
+			http.Error(w, "Failed to encode namespaces", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
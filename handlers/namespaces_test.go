@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameNameInTwoNamespaces(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags", func(w http.ResponseWriter, r *http.Request) { Tags(w, r, db) })
+	mux.HandleFunc("/v1/tags/{id}", func(w http.ResponseWriter, r *http.Request) { SingleTag(w, r, db) })
+
+	for _, body := range []string{`{"name":"location:Paris"}`, `{"name":"Paris","namespace":"person"}`, `{"name":"paris"}`} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/tags", bytes.NewBufferString(body)))
+		assert.Equal(t, http.StatusCreated, recorder.Code, body)
+	}
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/tags", bytes.NewBufferString(`{"name":"LOCATION:paris"}`)))
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags/person:paris", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var tag Tag
+	json.Unmarshal(recorder.Body.Bytes(), &tag)
+	assert.Equal(t, "person", tag.Namespace)
+	assert.Equal(t, "paris", tag.Name)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags?namespace=location", nil))
+	var tags []Tag
+	json.Unmarshal(recorder.Body.Bytes(), &tags)
+	if assert.Len(t, tags, 1) {
+		assert.Equal(t, "location", tags[0].Namespace)
+	}
+}
+
+func TestNamespacedUploadAndFilter(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) { AllMedia(w, r, db) })
+	mux.HandleFunc("/v1/namespaces", func(w http.ResponseWriter, r *http.Request) { Namespaces(w, r, db) })
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "eiffel", "Tags": `[{"Name":"location:paris"}, {"Name":"tower"}]`}, "../static/tests/bg.png"))
+	if status := recorder.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "hilton", "Tags": `[{"Name":"person:paris"}]`}, "../static/tests/bg.png"))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media?q=location:paris", nil))
+	var media []Media
+	json.Unmarshal(recorder.Body.Bytes(), &media)
+	if assert.Len(t, media, 1) {
+		assert.Equal(t, "eiffel", media[0].Name)
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/namespaces", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var namespaces []namespaceCount
+	json.Unmarshal(recorder.Body.Bytes(), &namespaces)
+	assert.Equal(t, []namespaceCount{{"", 1}, {"location", 1}, {"person", 1}}, namespaces)
+}
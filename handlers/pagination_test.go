@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePage(t *testing.T) {
+	p, err := parsePage(url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultPageSize, p.limit, "Expected lists to be bounded without a limit")
+	assert.Equal(t, "id", p.sort)
+
+	p, err = parsePage(url.Values{"limit": {"100000"}, "sort": {"-created_at"}})
+	assert.NoError(t, err)
+	assert.Equal(t, maxPageSize, p.limit, "Expected the page size to be capped")
+	assert.Equal(t, "created_at", p.sort)
+	assert.True(t, p.desc)
+
+	for _, query := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"ten"}},
+		{"sort": {"password"}},
+		{"cursor": {"not-a-cursor"}},
+	} {
+		_, err := parsePage(query)
+		assert.Error(t, err, "query %v should be rejected", query)
+	}
+
+	// a cursor is only valid for the sort it was issued with
+	cursor := page{sort: "name"}.nextCursor("tag1", Tag{}.Model)
+	_, err = parsePage(url.Values{"sort": {"name"}, "cursor": {cursor}})
+	assert.NoError(t, err)
+	_, err = parsePage(url.Values{"sort": {"-name"}, "cursor": {cursor}})
+	assert.Error(t, err)
+}
+
+func TestListTagsPaginated(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	for i := 5; i >= 1; i-- {
+		db.Create(&Tag{Name: fmt.Sprintf("tag%d", i)})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags", func(w http.ResponseWriter, r *http.Request) {
+		Tags(w, r, db)
+	})
+
+	names := []string{}
+	next := "/v1/tags?limit=2&sort=name"
+	for pages := 0; next != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", next, nil))
+		if status := recorder.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		assert.Equal(t, "5", recorder.Header().Get("X-Total-Count"))
+
+		var tags []Tag
+		if err := json.Unmarshal(recorder.Body.Bytes(), &tags); err != nil {
+			t.Fatalf("could not unmarshal response body: %v", err)
+		}
+		assert.LessOrEqual(t, len(tags), 2)
+		for _, tag := range tags {
+			names = append(names, tag.Name)
+		}
+
+		next = ""
+		if cursor := recorder.Header().Get("X-Next-Cursor"); cursor != "" {
+			next = "/v1/tags?limit=2&sort=name&cursor=" + cursor
+			assert.Contains(t, recorder.Header().Get("Link"), `rel="next"`)
+		}
+	}
+
+	assert.Equal(t, []string{"tag1", "tag2", "tag3", "tag4", "tag5"}, names)
+}
+
+func TestListMediaSortedDescending(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	db.Create([]Media{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media?sort=-name&limit=2", nil))
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var mediaResp []Media
+	if err := json.Unmarshal(recorder.Body.Bytes(), &mediaResp); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Len(t, mediaResp, 2)
+	assert.Equal(t, "c", mediaResp[0].Name)
+	assert.Equal(t, "b", mediaResp[1].Name)
+	assert.Equal(t, "3", recorder.Header().Get("X-Total-Count"))
+	assert.NotEmpty(t, recorder.Header().Get("X-Next-Cursor"))
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media?sort=size", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
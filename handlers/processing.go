@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bee-keeper/tags-api/jobs"
+	"gorm.io/gorm"
+)
+
+// Kinds of background jobs
+const (
+	// jobProcessMedia extracts the metadata and makes the renditions of a new media item
+	jobProcessMedia = "process_media"
+	// jobRulesBackfill applies the enabled tagging rules to every existing media item
+	jobRulesBackfill = "rules_backfill"
+)
+
+// Processing states of a media item
+const (
+	// processingPending media wait for a worker
+	processingPending = "pending"
+	// processingRunning media are being processed, or wait for a retry after a failed attempt
+	processingRunning = "processing"
+	// processingDone media have their metadata and renditions
+	processingDone = "done"
+	// processingFailed media failed every attempt, their job is left dead
+	processingFailed = "failed"
+	// processingRejected media were found infected on upload, their content is in the quarantine
+	// and they are never processed
+	processingRejected = "rejected"
+)
+
+// processMediaPayload - arguments of a process_media job
+type processMediaPayload struct {
+	MediaID uint `json:"media_id"`
+}
+
+// RegisterJobs tells the queue how to run the jobs the handlers enqueue
+func RegisterJobs(q *jobs.Queue) {
+	q.Handle(jobProcessMedia, processMedia)
+	q.Handle(jobRulesBackfill, runRulesBackfill)
+}
+
+// processMedia - job handler extracting the metadata of a media item, tagging it by the rules that
+// need the metadata and making its renditions
+func processMedia(ctx context.Context, db *gorm.DB, job *jobs.Job) error {
+	var payload processMediaPayload
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	var media Media
+	if err := db.First(&media, payload.MediaID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// deleted before its turn came, there is nothing left to do
+			return nil
+		}
+		return err
+	}
+	if err := setProcessingStatus(db, media.ID, processingRunning); err != nil {
+		return err
+	}
+
+	if err := runProcessingSteps(ctx, db, &media); err != nil {
+		if job.LastAttempt() {
+			if statusErr := setProcessingStatus(db, media.ID, processingFailed); statusErr != nil {
+				return errors.Join(err, statusErr)
+			}
+		}
+		return err
+	}
+	return setProcessingStatus(db, media.ID, processingDone)
+}
+
+// runProcessingSteps does the work of processMedia, each step can be run again by a retry
+func runProcessingSteps(ctx context.Context, db *gorm.DB, media *Media) error {
+	metadata, err := extractMetadata(ctx, media.Path, media.ContentType)
+	if err != nil {
+		return fmt.Errorf("metadata: %w", err)
+	}
+	media.Metadata = metadata
+	if err := db.Model(&Media{}).Where("id = ?", media.ID).Update("metadata", metadata).Error; err != nil {
+		return err
+	}
+
+	// rules reading the metadata only match now, the others were applied with the upload
+	rules, err := enabledRules(db)
+	if err != nil {
+		return err
+	}
+	if _, err := applyRules(db, rules, *media); err != nil {
+		return fmt.Errorf("rules: %w", err)
+	}
+
+	return generateRenditions(ctx, *media)
+}
+
+// setProcessingStatus records how far the processing of a media item got
+func setProcessingStatus(db *gorm.DB, id uint, status string) error {
+	return db.Model(&Media{}).Where("id = ?", id).Update("processing_status", status).Error
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bee-keeper/tags-api/jobs"
+	"github.com/bee-keeper/tags-api/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessMedia(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	previous, previousSizes := Store, ThumbnailSizes
+	Store = storage.NewLocal(t.TempDir())
+	ThumbnailSizes = []ThumbnailSpec{{64, 64, fitCover}}
+	defer func() { Store, ThumbnailSizes = previous, previousSizes }()
+
+	recorder := httptest.NewRecorder()
+	AllMedia(recorder, newUploadRequest(t, map[string]string{"Name": "background", "Tags": "[]"}, "../static/tests/bg.png"), db)
+	if status := recorder.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var media Media
+	json.Unmarshal(recorder.Body.Bytes(), &media)
+	assert.Equal(t, processingPending, media.ProcessingStatus)
+	assert.Zero(t, media.Metadata.Width, "Expected the metadata to wait for the job")
+
+	queue := jobs.NewQueue(db)
+	RegisterJobs(queue)
+	ran, err := queue.RunNext(context.Background())
+	assert.True(t, ran)
+	assert.NoError(t, err)
+
+	var processed Media
+	db.First(&processed, media.ID)
+	assert.Equal(t, processingDone, processed.ProcessingStatus)
+	assert.NotZero(t, processed.Metadata.Width)
+	_, err = Store.Stat(context.Background(), renditionKey(processed, ThumbnailSizes[0], "png"))
+	assert.NoError(t, err, "Expected the rendition to be made by the job")
+}
+
+func TestProcessMediaFailure(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	previous := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previous }()
+
+	// content gone from storage can't be processed
+	media := Media{Name: "missing", Path: "missing.png", ContentType: "image/png", ProcessingStatus: processingPending}
+	db.Create(&media)
+	job, err := jobs.Enqueue(db, jobProcessMedia, processMediaPayload{MediaID: media.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&job).Update("max_attempts", 1)
+
+	queue := jobs.NewQueue(db)
+	RegisterJobs(queue)
+	ran, err := queue.RunNext(context.Background())
+	assert.True(t, ran)
+	assert.Error(t, err)
+
+	db.First(&media, media.ID)
+	assert.Equal(t, processingFailed, media.ProcessingStatus)
+	db.First(&job, job.ID)
+	assert.Equal(t, jobs.StatusDead, job.Status)
+	assert.NotEmpty(t, job.LastError)
+}
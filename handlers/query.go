@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// queryError - syntax error in a tag query, Pos is the 1-based character position
+type queryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("Invalid query at position %d: %s", e.Pos, e.Msg)
+}
+
+// tagExpr - node of a parsed boolean tag query
+type tagExpr interface {
+	// sql compiles the node into a condition on media.id, resolve maps a tag name onto tag IDs
+	sql(resolve func(name string) []uint) (string, []any)
+	// names appends every tag name the node refers to
+	names(dst []string) []string
+}
+
+type tagTerm struct{ name string }
+type notExpr struct{ expr tagExpr }
+type andExpr struct{ left, right tagExpr }
+type orExpr struct{ left, right tagExpr }
+
+func (t tagTerm) sql(resolve func(string) []uint) (string, []any) {
+	return hasAnyTag(resolve(t.name))
+}
+
+func (n notExpr) sql(resolve func(string) []uint) (string, []any) {
+	cond, args := n.expr.sql(resolve)
+	return "NOT " + cond, args
+}
+
+func (a andExpr) sql(resolve func(string) []uint) (string, []any) {
+	left, leftArgs := a.left.sql(resolve)
+	right, rightArgs := a.right.sql(resolve)
+	return "(" + left + " AND " + right + ")", append(leftArgs, rightArgs...)
+}
+
+func (o orExpr) sql(resolve func(string) []uint) (string, []any) {
+	left, leftArgs := o.left.sql(resolve)
+	right, rightArgs := o.right.sql(resolve)
+	return "(" + left + " OR " + right + ")", append(leftArgs, rightArgs...)
+}
+
+func (t tagTerm) names(dst []string) []string { return append(dst, t.name) }
+func (n notExpr) names(dst []string) []string { return n.expr.names(dst) }
+func (a andExpr) names(dst []string) []string { return a.right.names(a.left.names(dst)) }
+func (o orExpr) names(dst []string) []string  { return o.right.names(o.left.names(dst)) }
+
+// hasAnyTag is a semi-join matching media carrying at least one of the tag IDs, served by
+// the media_tags primary key
+func hasAnyTag(tagIDs []uint) (string, []any) {
+	if len(tagIDs) == 0 {
+		return "FALSE", nil
+	}
+	return "EXISTS (SELECT 1 FROM media_tags WHERE media_tags.media_id = media.id AND media_tags.tag_id IN ?)", []any{tagIDs}
+}
+
+// queryToken - lexical token of a tag query
+type queryToken struct {
+	kind string // "word", "and", "or", "not", "(", ")" or "eof"
+	text string
+	pos  int // byte offset
+}
+
+// tagQueryParser - recursive descent parser for queries like `cat AND (outdoor OR garden) AND NOT blurry`.
+// NOT binds tightest, then AND, then OR; adjacent terms are joined with an implicit AND and
+// names containing spaces or keywords can be double quoted.
+type tagQueryParser struct {
+	src    string
+	tokens []queryToken
+	next   int
+}
+
+// parseTagQuery parses a boolean tag query
+func parseTagQuery(src string) (tagExpr, error) {
+	p := &tagQueryParser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == "eof" {
+		return nil, p.errorAt(p.peek(), "empty query")
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != "eof" {
+		return nil, p.errorAt(tok, fmt.Sprintf("unexpected %q", tok.text))
+	}
+	return expr, nil
+}
+
+func (p *tagQueryParser) lex() error {
+	src := p.src
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '(' || r == ')':
+			p.tokens = append(p.tokens, queryToken{kind: string(r), text: string(r), pos: i})
+			i += size
+		case r == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return p.errorAt(queryToken{pos: i}, "unterminated quote")
+			}
+			p.tokens = append(p.tokens, queryToken{kind: "word", text: src[i+1 : i+1+end], pos: i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(src) {
+				r, size := utf8.DecodeRuneInString(src[i:])
+				if unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' {
+					break
+				}
+				i += size
+			}
+			word := src[start:i]
+			kind := "word"
+			switch strings.ToUpper(word) {
+			case "AND":
+				kind = "and"
+			case "OR":
+				kind = "or"
+			case "NOT":
+				kind = "not"
+			}
+			p.tokens = append(p.tokens, queryToken{kind: kind, text: word, pos: start})
+		}
+	}
+	p.tokens = append(p.tokens, queryToken{kind: "eof", text: "end of query", pos: len(src)})
+	return nil
+}
+
+func (p *tagQueryParser) peek() queryToken {
+	return p.tokens[p.next]
+}
+
+func (p *tagQueryParser) advance() queryToken {
+	tok := p.tokens[p.next]
+	if tok.kind != "eof" {
+		p.next++
+	}
+	return tok
+}
+
+func (p *tagQueryParser) errorAt(tok queryToken, msg string) error {
+	return &queryError{Pos: utf8.RuneCountInString(p.src[:tok.pos]) + 1, Msg: msg}
+}
+
+func (p *tagQueryParser) parseOr() (tagExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "or" {
+		p.advance()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *tagQueryParser) parseAnd() (tagExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case "and":
+			p.advance()
+		case "word", "not", "(":
+			// implicit AND between adjacent terms
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+}
+
+func (p *tagQueryParser) parseUnary() (tagExpr, error) {
+	tok := p.advance()
+	switch tok.kind {
+	case "not":
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	case "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.advance(); closing.kind != ")" {
+			return nil, p.errorAt(closing, "expected ')'")
+		}
+		return expr, nil
+	case "word":
+		if tok.text == "" {
+			return nil, p.errorAt(tok, "empty tag name")
+		}
+		return tagTerm{tok.text}, nil
+	case "eof":
+		return nil, p.errorAt(tok, "expected a tag name")
+	default:
+		return nil, p.errorAt(tok, fmt.Sprintf("expected a tag name, got %q", tok.text))
+	}
+}
+
+// mediaFilter - tag and metadata conditions requested on GET /v1/media
+type mediaFilter struct {
+	all  []uint  // tag=1,2 every one of these tag IDs
+	any  []uint  // any=3,4 at least one of these tag IDs
+	none []uint  // not=5 none of these tag IDs
+	expr tagExpr // q=cat AND NOT blurry by tag name
+	// descendants=true also matches media carrying a tag below the requested ones
+	descendants bool
+	// metadata bounds the extracted metadata, width_gte=1000 or taken_after=2024-01-01
+	metadata []metadataBound
+}
+
+// metadataBound - condition on one field of the media metadata
+type metadataBound struct {
+	cond string
+	arg  any
+}
+
+// metadataParams are the metadata filters and the conditions they add, taken_after includes the
+// instant given and taken_before excludes it
+var metadataParams = []struct {
+	param string
+	cond  string
+	date  bool
+}{
+	{"width_gte", "(media.metadata->>'width')::int >= ?", false},
+	{"width_lte", "(media.metadata->>'width')::int <= ?", false},
+	{"height_gte", "(media.metadata->>'height')::int >= ?", false},
+	{"height_lte", "(media.metadata->>'height')::int <= ?", false},
+	{"taken_after", "(media.metadata->>'taken_at')::timestamptz >= ?", true},
+	{"taken_before", "(media.metadata->>'taken_at')::timestamptz < ?", true},
+}
+
+// parseMediaFilter reads the tag filters from the query string, errors are meant for the client
+func parseMediaFilter(query url.Values) (mediaFilter, error) {
+	var f mediaFilter
+	var err error
+	if f.all, err = parseIDList(query.Get("tag")); err != nil {
+		return f, err
+	}
+	if f.any, err = parseIDList(query.Get("any")); err != nil {
+		return f, err
+	}
+	if f.none, err = parseIDList(query.Get("not")); err != nil {
+		return f, err
+	}
+	if q := query.Get("q"); q != "" {
+		if f.expr, err = parseTagQuery(q); err != nil {
+			return f, err
+		}
+	}
+	if descendants := query.Get("descendants"); descendants != "" {
+		if f.descendants, err = strconv.ParseBool(descendants); err != nil {
+			return f, fmt.Errorf("Invalid descendants value %q", descendants)
+		}
+	}
+	for _, param := range metadataParams {
+		value := query.Get(param.param)
+		if value == "" {
+			continue
+		}
+		bound := metadataBound{cond: param.cond}
+		if param.date {
+			at, err := parseDate(value)
+			if err != nil {
+				return f, fmt.Errorf("Invalid %s %q, expected a date like 2024-01-01 or RFC 3339", param.param, value)
+			}
+			bound.arg = at
+		} else {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return f, fmt.Errorf("Invalid %s %q", param.param, value)
+			}
+			bound.arg = n
+		}
+		f.metadata = append(f.metadata, bound)
+	}
+	return f, nil
+}
+
+// parseDate reads a date or an RFC 3339 time, dates are midnight UTC
+func parseDate(value string) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// parseIDList parses a comma separated list of tag IDs
+func parseIDList(list string) ([]uint, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var ids []uint
+	for _, part := range strings.Split(list, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tag ID %q", part)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// apply adds the filter conditions to a media query, looking up the tags named in the expression.
+// It also returns the alias each tag was matched through, by tag ID.
+func (f mediaFilter) apply(db *gorm.DB, query *gorm.DB) (*gorm.DB, map[uint]string, error) {
+	matched := map[uint]string{}
+	// expand widens a set of tag IDs to their subtrees when descendants were requested
+	expand := func(ids []uint) ([]uint, error) {
+		if !f.descendants {
+			return ids, nil
+		}
+		return descendantIDs(db, ids)
+	}
+
+	for _, id := range f.all {
+		ids, err := expand([]uint{id})
+		if err != nil {
+			return nil, nil, err
+		}
+		cond, args := hasAnyTag(ids)
+		query = query.Where(cond, args...)
+	}
+	if len(f.any) > 0 {
+		ids, err := expand(f.any)
+		if err != nil {
+			return nil, nil, err
+		}
+		cond, args := hasAnyTag(ids)
+		query = query.Where(cond, args...)
+	}
+	if len(f.none) > 0 {
+		ids, err := expand(f.none)
+		if err != nil {
+			return nil, nil, err
+		}
+		cond, args := hasAnyTag(ids)
+		query = query.Where("NOT "+cond, args...)
+	}
+
+	for _, bound := range f.metadata {
+		query = query.Where(bound.cond, bound.arg)
+	}
+
+	if f.expr != nil {
+		names := f.expr.names(nil)
+		pairs := make([][]any, len(names))
+		for i, name := range names {
+			names[i] = normalizeQualifiedName(name)
+			namespace, name := splitTagName(names[i])
+			pairs[i] = []any{namespace, name}
+		}
+		var tags []Tag
+		if err := db.Where("(namespace, name) IN ?", pairs).Find(&tags).Error; err != nil {
+			return nil, nil, err
+		}
+		byName := map[string][]uint{}
+		for _, tag := range tags {
+			byName[tag.qualifiedName()] = append(byName[tag.qualifiedName()], tag.ID)
+		}
+		aliased, err := resolveAliases(db, names)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, tag := range aliased {
+			byName[name] = append(byName[name], tag.ID)
+			matched[tag.ID] = tag.MatchedAlias
+		}
+		if f.descendants {
+			for name, ids := range byName {
+				expanded, err := expand(ids)
+				if err != nil {
+					return nil, nil, err
+				}
+				byName[name] = expanded
+			}
+		}
+		cond, args := f.expr.sql(func(name string) []uint { return byName[normalizeQualifiedName(name)] })
+		query = query.Where(cond, args...)
+	}
+
+	return query, matched, nil
+}
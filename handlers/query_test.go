@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTagQuery(t *testing.T) {
+	cases := map[string]string{
+		"cat":                 "cat",
+		"cat AND dog":         "(cat AND dog)",
+		"cat dog":             "(cat AND dog)",
+		"cat OR dog AND bird": "(cat OR (dog AND bird))",
+		"cat AND (outdoor OR garden) AND NOT blurry": "((cat AND (outdoor OR garden)) AND NOT blurry)",
+		"not not cat":         "NOT NOT cat",
+		`"new york" or "and"`: "(new york OR and)",
+		"(cat)":               "cat",
+	}
+	for src, expected := range cases {
+		expr, err := parseTagQuery(src)
+		if !assert.NoError(t, err, src) {
+			continue
+		}
+		assert.Equal(t, expected, exprString(expr), src)
+	}
+}
+
+func TestParseTagQueryErrors(t *testing.T) {
+	cases := map[string]int{
+		"":                  1,
+		"cat AND":           8,
+		"(cat OR dog":       12,
+		"cat)":              4,
+		"cat AND OR dog":    9,
+		`cat "unterminated`: 5,
+		"ünï AND )":         9,
+	}
+	for src, pos := range cases {
+		_, err := parseTagQuery(src)
+		var qErr *queryError
+		if assert.ErrorAs(t, err, &qErr, src) {
+			assert.Equal(t, pos, qErr.Pos, "%q: %v", src, err)
+		}
+	}
+}
+
+func TestTagExprSQL(t *testing.T) {
+	expr, err := parseTagQuery("cat AND NOT (dog OR unknown)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string][]uint{"cat": {1}, "dog": {2}}
+	cond, args := expr.sql(func(name string) []uint { return ids[name] })
+
+	exists := "EXISTS (SELECT 1 FROM media_tags WHERE media_tags.media_id = media.id AND media_tags.tag_id IN ?)"
+	assert.Equal(t, "("+exists+" AND NOT ("+exists+" OR FALSE))", cond)
+	assert.Equal(t, []any{[]uint{1}, []uint{2}}, args)
+}
+
+// exprString renders a parsed query back with explicit grouping
+func exprString(e tagExpr) string {
+	switch e := e.(type) {
+	case tagTerm:
+		return e.name
+	case notExpr:
+		return "NOT " + exprString(e.expr)
+	case andExpr:
+		return "(" + exprString(e.left) + " AND " + exprString(e.right) + ")"
+	case orExpr:
+		return "(" + exprString(e.left) + " OR " + exprString(e.right) + ")"
+	}
+	return fmt.Sprintf("%T", e)
+}
+
+func TestFilterMediaByTags(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	var cat, outdoor, garden, blurry Tag
+	db.FirstOrCreate(&cat, Tag{Name: "cat"})
+	db.FirstOrCreate(&outdoor, Tag{Name: "outdoor"})
+	db.FirstOrCreate(&garden, Tag{Name: "garden"})
+	db.FirstOrCreate(&blurry, Tag{Name: "blurry"})
+
+	result := db.Create([]Media{
+		{Name: "media1", Tags: []*Tag{&cat, &outdoor}},
+		{Name: "media2", Tags: []*Tag{&cat, &garden, &blurry}},
+		{Name: "media3", Tags: []*Tag{&cat}},
+		{Name: "media4", Tags: []*Tag{&outdoor, &garden}},
+	})
+	if result.Error != nil {
+		t.Fatalf("Failed to create media: %v", result.Error)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+
+	id := func(tag Tag) string { return fmt.Sprint(tag.ID) }
+	cases := map[string][]string{
+		"tag=" + id(cat) + "," + id(outdoor):                                 {"media1"},
+		"any=" + id(blurry) + "," + id(outdoor):                              {"media1", "media2", "media4"},
+		"tag=" + id(cat) + "&not=" + id(blurry):                              {"media1", "media3"},
+		"q=" + url.QueryEscape("cat AND (outdoor OR garden) AND NOT blurry"): {"media1"},
+		"q=" + url.QueryEscape("garden OR missing"):                          {"media2", "media4"},
+		"q=missing": {},
+	}
+	for query, expected := range cases {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media?"+query, nil))
+		if !assert.Equal(t, http.StatusOK, recorder.Code, query) {
+			continue
+		}
+
+		var mediaResp []Media
+		if err := json.Unmarshal(recorder.Body.Bytes(), &mediaResp); err != nil {
+			t.Fatalf("could not unmarshal response body: %v", err)
+		}
+		names := []string{}
+		for _, media := range mediaResp {
+			names = append(names, media.Name)
+		}
+		assert.ElementsMatch(t, expected, names, query)
+		assert.Equal(t, fmt.Sprint(len(expected)), recorder.Header().Get("X-Total-Count"), query)
+	}
+}
+
+func TestFilterMediaInvalidQuery(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media?q="+url.QueryEscape("cat AND (dog"), nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Invalid query at position 13: expected ')'\n", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media?any=1,x", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
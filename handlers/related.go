@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// defaultRelatedLimit is how many tags the related and suggested tag endpoints return without a limit
+const defaultRelatedLimit = 10
+
+// relatedTag - tag ranked by how often it appears together with other tags
+type relatedTag struct {
+	Tag
+	Score float64 `json:"score"`
+	// CoOccurrences is the number of media carrying both tags, summed over the tags compared against
+	CoOccurrences int64 `json:"co_occurrences"`
+}
+
+// cooccurrence - counts behind a co-occurrence score of the tags a and b
+type cooccurrence struct {
+	together int64 // media carrying both tags
+	a, b     int64 // media carrying each tag
+	total    int64 // media overall
+}
+
+// cooccurrenceMetrics score how strongly two tags belong together
+var cooccurrenceMetrics = map[string]func(c cooccurrence) float64{
+	// jaccard is the share of media carrying either tag that carry both, between 0 and 1
+	"jaccard": func(c cooccurrence) float64 {
+		union := c.a + c.b - c.together
+		if union <= 0 {
+			return 0
+		}
+		return float64(c.together) / float64(union)
+	},
+	// pmi is the pointwise mutual information in bits, positive when the tags appear together
+	// more often than chance would have them
+	"pmi": func(c cooccurrence) float64 {
+		if c.together == 0 || c.a == 0 || c.b == 0 || c.total == 0 {
+			return 0
+		}
+		return math.Log2(float64(c.together) * float64(c.total) / (float64(c.a) * float64(c.b)))
+	},
+}
+
+// relatedParams reads the metric, limit and min_count shared by the related and suggested tag endpoints
+func relatedParams(query url.Values) (metric func(cooccurrence) float64, limit int, minCount int64, err error) {
+	name := query.Get("metric")
+	if name == "" {
+		name = "jaccard"
+	}
+	metric, ok := cooccurrenceMetrics[name]
+	if !ok {
+		return nil, 0, 0, fmt.Errorf("Invalid metric %q, must be jaccard or pmi", name)
+	}
+	limit = defaultRelatedLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, 0, 0, fmt.Errorf("Invalid limit, must be between 1 and %d", maxPageSize)
+		}
+		limit = n
+	}
+	// rare pairs get extreme scores, min_count drops pairs seen together fewer times
+	minCount = 1
+	if minStr := query.Get("min_count"); minStr != "" {
+		n, err := strconv.ParseInt(minStr, 10, 64)
+		if err != nil || n < 1 {
+			return nil, 0, 0, fmt.Errorf("Invalid min_count %q", minStr)
+		}
+		minCount = n
+	}
+	return metric, limit, minCount, nil
+}
+
+// rankRelated scores the tags co-occurring with any of the given tags, skipping the given tags
+// themselves. A candidate's score is the sum of its scores against each of them.
+func rankRelated(db *gorm.DB, tags []Tag, metric func(cooccurrence) float64, limit int, minCount int64) ([]relatedTag, error) {
+	related := []relatedTag{}
+	if len(tags) == 0 {
+		return related, nil
+	}
+	ids := make([]uint, len(tags))
+	usage := map[uint]int64{}
+	for i, tag := range tags {
+		ids[i] = tag.ID
+		usage[tag.ID] = tag.UsageCount
+	}
+
+	var pairs []struct {
+		TagID    uint
+		OtherID  uint
+		Together int64
+	}
+	if err := db.Raw(`SELECT self.tag_id, other.tag_id AS other_id, COUNT(*) AS together
+		FROM media_tags self
+		JOIN media_tags other ON other.media_id = self.media_id
+		WHERE self.tag_id IN ? AND other.tag_id NOT IN ?
+		GROUP BY self.tag_id, other.tag_id
+		HAVING COUNT(*) >= ?`, ids, ids, minCount).Scan(&pairs).Error; err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return related, nil
+	}
+
+	var total int64
+	if err := db.Model(&Media{}).Count(&total).Error; err != nil {
+		return nil, err
+	}
+	var candidateIDs []uint
+	for _, pair := range pairs {
+		candidateIDs = append(candidateIDs, pair.OtherID)
+	}
+	var candidates []Tag
+	if err := db.Find(&candidates, uniqueIDs(candidateIDs)).Error; err != nil {
+		return nil, err
+	}
+	byID := map[uint]*relatedTag{}
+	for _, candidate := range candidates {
+		byID[candidate.ID] = &relatedTag{Tag: candidate}
+	}
+
+	for _, pair := range pairs {
+		candidate, ok := byID[pair.OtherID]
+		if !ok {
+			continue
+		}
+		candidate.Score += metric(cooccurrence{
+			together: pair.Together,
+			a:        usage[pair.TagID],
+			b:        candidate.UsageCount,
+			total:    total,
+		})
+		candidate.CoOccurrences += pair.Together
+	}
+	for _, candidate := range byID {
+		count := candidate.UsageCount
+		candidate.MediaCount = &count
+		related = append(related, *candidate)
+	}
+	sort.Slice(related, func(i, j int) bool {
+		if related[i].Score != related[j].Score {
+			return related[i].Score > related[j].Score
+		}
+		if related[i].CoOccurrences != related[j].CoOccurrences {
+			return related[i].CoOccurrences > related[j].CoOccurrences
+		}
+		return related[i].Name < related[j].Name
+	})
+	if len(related) > limit {
+		related = related[:limit]
+	}
+	return related, nil
+}
+
+// RelatedTags - the tags that most often appear on the same media as a tag, scored by ?metric=jaccard or pmi
+func RelatedTags(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	idOrName := r.PathValue("id")
+	if idOrName == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		metric, limit, minCount, err := relatedParams(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var tag Tag
+		if !loadTag(w, db, idOrName, &tag) {
+			return
+		}
+		related, err := rankRelated(db, []Tag{tag}, metric, limit, minCount)
+		if err != nil {
+			http.Error(w, "Failed to fetch related tags", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(related); err != nil {
+			http.Error(w, "Failed to encode tags", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SuggestedMediaTags - tags a media item doesn't carry yet but that often appear with the ones it has
+func SuggestedMediaTags(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		metric, limit, minCount, err := relatedParams(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var media Media
+		if !loadMedia(w, db, uint(id), &media) {
+			return
+		}
+		tags := make([]Tag, len(media.Tags))
+		for i, tag := range media.Tags {
+			tags[i] = *tag
+		}
+		suggested, err := rankRelated(db, tags, metric, limit, minCount)
+		if err != nil {
+			http.Error(w, "Failed to fetch suggested tags", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(suggested); err != nil {
+			http.Error(w, "Failed to encode tags", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCooccurrenceMetrics(t *testing.T) {
+	jaccard, pmi := cooccurrenceMetrics["jaccard"], cooccurrenceMetrics["pmi"]
+
+	assert.InDelta(t, 0.5, jaccard(cooccurrence{together: 2, a: 2, b: 4, total: 10}), 1e-9)
+	assert.Equal(t, 0.0, jaccard(cooccurrence{}))
+
+	// always together in half of all media: twice as likely as chance, one bit
+	assert.InDelta(t, 1.0, pmi(cooccurrence{together: 5, a: 5, b: 5, total: 10}), 1e-9)
+	// independent tags score zero
+	assert.InDelta(t, 0.0, pmi(cooccurrence{together: 1, a: 2, b: 5, total: 10}), 1e-9)
+	assert.Equal(t, 0.0, pmi(cooccurrence{a: 2, b: 5, total: 10}))
+}
+
+func TestRelatedTags(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	cat := Tag{Name: "cat"}
+	kitten := Tag{Name: "kitten"}
+	garden := Tag{Name: "garden"}
+	car := Tag{Name: "car"}
+	for _, tag := range []*Tag{&cat, &kitten, &garden, &car} {
+		db.Create(tag)
+	}
+	db.Create(&Media{Name: "media1", Tags: []*Tag{&cat, &kitten}})
+	db.Create(&Media{Name: "media2", Tags: []*Tag{&cat, &kitten, &garden}})
+	db.Create(&Media{Name: "media3", Tags: []*Tag{&garden, &car}})
+	db.Create(&Media{Name: "media4", Tags: []*Tag{&car}})
+	recountUsage(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/{id}/related", func(w http.ResponseWriter, r *http.Request) { RelatedTags(w, r, db) })
+
+	for _, metric := range []string{"jaccard", "pmi"} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/tags/%d/related?metric=%s", cat.ID, metric), nil))
+		if status := recorder.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var related []relatedTag
+		if err := json.Unmarshal(recorder.Body.Bytes(), &related); err != nil {
+			t.Fatalf("could not unmarshal response body: %v", err)
+		}
+		if assert.Len(t, related, 2, metric) {
+			assert.Equal(t, "kitten", related[0].Name, metric)
+			assert.Equal(t, int64(2), related[0].CoOccurrences, metric)
+			assert.Equal(t, "garden", related[1].Name, metric)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/tags/%d/related?min_count=2", cat.ID), nil))
+	var related []relatedTag
+	json.Unmarshal(recorder.Body.Bytes(), &related)
+	assert.Len(t, related, 1)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/tags/%d/related?metric=cosine", cat.ID), nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestSuggestedMediaTags(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	cat := Tag{Name: "cat"}
+	kitten := Tag{Name: "kitten"}
+	garden := Tag{Name: "garden"}
+	for _, tag := range []*Tag{&cat, &kitten, &garden} {
+		db.Create(tag)
+	}
+	db.Create(&Media{Name: "media1", Tags: []*Tag{&cat, &kitten}})
+	db.Create(&Media{Name: "media2", Tags: []*Tag{&cat, &kitten}})
+	db.Create(&Media{Name: "media3", Tags: []*Tag{&cat, &garden}})
+	sparse := Media{Name: "sparse", Tags: []*Tag{&cat}}
+	db.Create(&sparse)
+	recountUsage(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media/{id}/suggested-tags", func(w http.ResponseWriter, r *http.Request) { SuggestedMediaTags(w, r, db) })
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/media/%d/suggested-tags", sparse.ID), nil))
+	if status := recorder.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var suggested []relatedTag
+	json.Unmarshal(recorder.Body.Bytes(), &suggested)
+	if assert.Len(t, suggested, 2) {
+		assert.Equal(t, "kitten", suggested[0].Name)
+		assert.Equal(t, "garden", suggested[1].Name)
+	}
+}
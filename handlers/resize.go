@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// contribution - weight of one source pixel in a resampled pixel
+type contribution struct {
+	index  int
+	weight float32
+}
+
+// boxWeights spreads srcLen pixels over dstLen ones, each destination pixel averaging the source
+// pixels it covers weighted by how much of them it covers. It only ever shrinks.
+func boxWeights(srcLen, dstLen int) [][]contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	weights := make([][]contribution, dstLen)
+	for i := range weights {
+		start, end := float64(i)*scale, float64(i+1)*scale
+		for j := int(start); j < srcLen && float64(j) < end; j++ {
+			overlap := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+			if overlap > 0 {
+				weights[i] = append(weights[i], contribution{index: j, weight: float32(overlap / scale)})
+			}
+		}
+	}
+	return weights
+}
+
+// resample scales the crop rectangle of src down to width x height with a box filter. Colors are
+// averaged premultiplied so transparent pixels don't bleed into their neighbours. Pixels are read
+// from src a row at a time and each result row is made from the few source rows it covers, so
+// besides the result it only takes a couple of rows of memory.
+func resample(src image.Image, crop image.Rectangle, width, height int) *image.RGBA {
+	srcW, srcH := crop.Dx(), crop.Dy()
+	columns := boxWeights(srcW, width)
+	rows := boxWeights(srcH, height)
+
+	// line holds the source row being read, scaled the row scaled horizontally
+	line := image.NewRGBA(image.Rect(0, 0, srcW, 1))
+	scaled := make([]float32, width*4)
+	scaledRow := -1
+	sum := make([]float32, width*4)
+
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, weights := range rows {
+		clear(sum)
+		for _, row := range weights {
+			// the last source row of a result row is often the first of the next
+			if row.index != scaledRow {
+				draw.Draw(line, line.Bounds(), src, image.Pt(crop.Min.X, crop.Min.Y+row.index), draw.Src)
+				scaleRow(scaled, line.Pix, columns)
+				scaledRow = row.index
+			}
+			for i, v := range scaled {
+				sum[i] += v * row.weight
+			}
+		}
+		o := y * out.Stride
+		for i, v := range sum {
+			out.Pix[o+i] = clampByte(v)
+		}
+	}
+	return out
+}
+
+// scaleRow resamples a row of RGBA pixels horizontally into dst, four floats a pixel
+func scaleRow(dst []float32, line []uint8, columns [][]contribution) {
+	for x, weights := range columns {
+		var r, g, b, a float32
+		for _, c := range weights {
+			p := line[c.index*4:]
+			r += float32(p[0]) * c.weight
+			g += float32(p[1]) * c.weight
+			b += float32(p[2]) * c.weight
+			a += float32(p[3]) * c.weight
+		}
+		dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = r, g, b, a
+	}
+}
+
+func clampByte(v float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	default:
+		return uint8(v + 0.5)
+	}
+}
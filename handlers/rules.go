@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bee-keeper/tags-api/jobs"
+	"gorm.io/gorm"
+)
+
+// backfillBatchSize is how many media a rules backfill loads at a time
+const backfillBatchSize = 100
+
+// backfillLockKey serializes queueing backfills, so two requests can't both find none queued
+const backfillLockKey = 7_311_991
+
+// ruleFields read the attribute of a media item a rule looks at
+var ruleFields = map[string]func(m Media) string{
+	// ext is the extension of the uploaded file name, lower case and without the dot
+	"ext": func(m Media) string {
+		return strings.TrimPrefix(strings.ToLower(filepath.Ext(m.OriginalFilename)), ".")
+	},
+	"name":         func(m Media) string { return m.Name },
+	"filename":     func(m Media) string { return m.OriginalFilename },
+	"content_type": func(m Media) string { return baseMediaType(m.ContentType) },
+	"camera":       func(m Media) string { return m.Metadata.Camera },
+}
+
+// ruleOps compare an attribute with the value of a rule, equals and contains ignore case
+var ruleOps = map[string]func(attr string, rule *TagRule) bool{
+	"equals": func(attr string, rule *TagRule) bool { return strings.EqualFold(attr, rule.Value) },
+	"contains": func(attr string, rule *TagRule) bool {
+		return strings.Contains(strings.ToLower(attr), strings.ToLower(rule.Value))
+	},
+	// the pattern is compiled once, when the rule is loaded
+	"regex": func(attr string, rule *TagRule) bool { return rule.pattern != nil && rule.pattern.MatchString(attr) },
+}
+
+// TagRule - applies a tag to uploaded media whose attribute matches, e.g. ext equals png -> "image"
+type TagRule struct {
+	gorm.Model
+	Description string `json:"description"`
+	// Field is ext, name, filename, content_type or camera
+	Field string `json:"field" gorm:"not null"`
+	// Op is equals, contains or regex
+	Op    string `json:"op" gorm:"not null"`
+	Value string `json:"value" gorm:"not null"`
+	// Tag is the name of the tag applied, created on first use
+	Tag     string `json:"tag" gorm:"not null"`
+	Enabled bool   `json:"enabled" gorm:"not null"`
+	// pattern is the compiled Value of a regex rule
+	pattern *regexp.Regexp
+}
+
+// validate checks the field, op and value of a rule and normalizes the tag name
+func (r *TagRule) validate() error {
+	if _, ok := ruleFields[r.Field]; !ok {
+		return errors.New("Field must be ext, name, filename, content_type or camera")
+	}
+	if r.Op == "" {
+		r.Op = "equals"
+	}
+	if _, ok := ruleOps[r.Op]; !ok {
+		return errors.New("Op must be equals, contains or regex")
+	}
+	if r.Value == "" {
+		return errors.New("Value is required")
+	}
+	if err := r.compile(); err != nil {
+		return fmt.Errorf("Invalid regex: %v", err)
+	}
+	tag := Tag{Name: r.Tag}
+	if err := tag.normalize(); err != nil {
+		return err
+	}
+	r.Tag = tag.qualifiedName()
+	return nil
+}
+
+// compile prepares the pattern of a regex rule
+func (r *TagRule) compile() error {
+	r.pattern = nil
+	if r.Op != "regex" {
+		return nil
+	}
+	pattern, err := regexp.Compile(r.Value)
+	if err != nil {
+		return err
+	}
+	r.pattern = pattern
+	return nil
+}
+
+// matches reports whether the rule applies to the media
+func (r *TagRule) matches(media Media) bool {
+	field, op := ruleFields[r.Field], ruleOps[r.Op]
+	if field == nil || op == nil {
+		return false
+	}
+	return op(field(media), r)
+}
+
+// enabledRules loads the rules applied to uploads, ready to match
+func enabledRules(db *gorm.DB) ([]TagRule, error) {
+	var rules []TagRule
+	if err := db.Where("enabled").Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	compileRules(rules)
+	return rules, nil
+}
+
+// compileRules compiles the patterns of regex rules. A stored pattern that no longer compiles is
+// logged and its rule never matches.
+func compileRules(rules []TagRule) {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			log.Printf("rule %d never matches, its regex is invalid: %v", rules[i].ID, err)
+		}
+	}
+}
+
+// ruleTags returns the tags the rules apply to the media
+func ruleTags(rules []TagRule, media Media) []Tag {
+	var tags []Tag
+	for i := range rules {
+		if rule := &rules[i]; rule.matches(media) {
+			tags = append(tags, Tag{Name: rule.Tag})
+		}
+	}
+	return tags
+}
+
+// applyRules adds the tags of matching rules to one existing media item, it never removes tags.
+// It reports whether any tag was added.
+func applyRules(db *gorm.DB, rules []TagRule, media Media) (bool, error) {
+	tags := ruleTags(rules, media)
+	if len(tags) == 0 {
+		return false, nil
+	}
+	var added []uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// media deleted since it was loaded are skipped
+		var exists []uint
+		if err := tx.Raw("SELECT id FROM media WHERE id = ? FOR SHARE", media.ID).Scan(&exists).Error; err != nil {
+			return err
+		}
+		if len(exists) == 0 {
+			return nil
+		}
+		dbTags, err := ensureTags(tx, tags)
+		if err != nil {
+			return err
+		}
+		// tags the media already carries are left alone, only new rows are counted
+		if err := tx.Raw(`INSERT INTO media_tags (media_id, tag_id) SELECT ?, id FROM tags WHERE id IN ?
+			ON CONFLICT DO NOTHING RETURNING tag_id`, media.ID, tagIDs(dbTags)).Scan(&added).Error; err != nil {
+			return err
+		}
+		return adjustUsage(tx, added, 1)
+	})
+	return len(added) > 0, err
+}
+
+// backfillRules applies the enabled rules to every existing media item and returns how many got new tags.
+// Rejected media never get tags.
+func backfillRules(ctx context.Context, db *gorm.DB) (int, error) {
+	rules, err := enabledRules(db)
+	if err != nil || len(rules) == 0 {
+		return 0, err
+	}
+	tagged := 0
+	var batch []Media
+	result := db.Where("processing_status <> ?", processingRejected).Order("id").FindInBatches(&batch, backfillBatchSize, func(_ *gorm.DB, _ int) error {
+		for _, media := range batch {
+			// stopped by a shutdown, a later run picks up where this one left off
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			changed, err := applyRules(db, rules, media)
+			if err != nil {
+				return fmt.Errorf("media %d: %w", media.ID, err)
+			}
+			if changed {
+				tagged++
+			}
+		}
+		return nil
+	})
+	return tagged, result.Error
+}
+
+// runRulesBackfill - job handler applying the enabled rules to every existing media item
+func runRulesBackfill(ctx context.Context, db *gorm.DB, job *jobs.Job) error {
+	tagged, err := backfillRules(ctx, db)
+	if err != nil {
+		return err
+	}
+	log.Printf("rules backfill job %d tagged %d media", job.ID, tagged)
+	return nil
+}
+
+// Rules - HTTP methods for tagging rule operations
+func Rules(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.URL.Path != "/v1/rules" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rules := []TagRule{}
+		if result := db.Order("id").Find(&rules); result.Error != nil {
+			http.Error(w, "Failed to fetch rules", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rules); err != nil {
+			http.Error(w, "Failed to encode rules", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost:
+		// rules are enabled unless sent otherwise
+		rule := TagRule{Enabled: true}
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		rule.Model = gorm.Model{}
+		if err := rule.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.Create(&rule).Error; err != nil {
+			http.Error(w, "Failed to create rule", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SingleRule - HTTP methods for operations on one tagging rule
+func SingleRule(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var rule TagRule
+		if !loadRule(w, db, uint(id), &rule) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rule); err != nil {
+			http.Error(w, "Failed to encode rule", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPatch:
+		var rule TagRule
+		if !loadRule(w, db, uint(id), &rule) {
+			return
+		}
+		var patch struct {
+			Description *string `json:"description"`
+			Field       *string `json:"field"`
+			Op          *string `json:"op"`
+			Value       *string `json:"value"`
+			Tag         *string `json:"tag"`
+			Enabled     *bool   `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		for _, field := range []struct {
+			value *string
+			dest  *string
+		}{{patch.Description, &rule.Description}, {patch.Field, &rule.Field}, {patch.Op, &rule.Op}, {patch.Value, &rule.Value}, {patch.Tag, &rule.Tag}} {
+			if field.value != nil {
+				*field.dest = *field.value
+			}
+		}
+		if patch.Enabled != nil {
+			rule.Enabled = *patch.Enabled
+		}
+		if err := rule.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.Save(&rule).Error; err != nil {
+			http.Error(w, "Failed to update rule", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rule); err != nil {
+			http.Error(w, "Failed to encode rule", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodDelete:
+		var rule TagRule
+		if !loadRule(w, db, uint(id), &rule) {
+			return
+		}
+		// tags applied by the rule stay on the media
+		if err := db.Unscoped().Delete(&rule).Error; err != nil {
+			http.Error(w, "Failed to delete rule", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, PATCH, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RulesBackfill - POST queues a job applying the enabled rules to existing media, GET returns the
+// latest such job
+func RulesBackfill(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	switch r.Method {
+	case http.MethodGet:
+		var job jobs.Job
+		if err := db.Where("kind = ?", jobRulesBackfill).Order("id DESC").First(&job).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "No backfill has run", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to fetch backfill", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(job); err != nil {
+			http.Error(w, "Failed to encode backfill", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPost:
+		var job jobs.Job
+		queued := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", backfillLockKey).Error; err != nil {
+				return err
+			}
+			var active int64
+			if err := tx.Model(&jobs.Job{}).Where("kind = ? AND status IN ?", jobRulesBackfill,
+				[]jobs.Status{jobs.StatusPending, jobs.StatusRunning}).Count(&active).Error; err != nil {
+				return err
+			}
+			if active > 0 {
+				return nil
+			}
+			var err error
+			job, err = jobs.Enqueue(tx, jobRulesBackfill, struct{}{})
+			queued = err == nil
+			return err
+		})
+		if err != nil {
+			http.Error(w, "Failed to queue backfill", http.StatusInternalServerError)
+			return
+		}
+		if !queued {
+			http.Error(w, "A backfill is already queued or running", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/v1/jobs/%d", job.ID))
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadRule fetches a tagging rule, writing the error response if it can't
+func loadRule(w http.ResponseWriter, db *gorm.DB, id uint, rule *TagRule) bool {
+	if err := db.First(rule, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return false
+		}
+		http.Error(w, "Failed to fetch rule", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bee-keeper/tags-api/jobs"
+	"github.com/bee-keeper/tags-api/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// mediaTagNames lists the names of the tags a media item carries
+func mediaTagNames(media Media) []string {
+	names := []string{}
+	for _, tag := range media.Tags {
+		names = append(names, tag.Name)
+	}
+	return names
+}
+
+func TestTagRuleValidate(t *testing.T) {
+	rule := TagRule{Field: "ext", Value: "png", Tag: " Image "}
+	assert.NoError(t, rule.validate())
+	assert.Equal(t, "equals", rule.Op)
+	assert.Equal(t, "image", rule.Tag)
+
+	for _, invalid := range []TagRule{
+		{Field: "size", Value: "1", Tag: "big"},
+		{Field: "name", Op: "like", Value: "x", Tag: "x"},
+		{Field: "name", Op: "regex", Value: "(", Tag: "x"},
+		{Field: "name", Value: "", Tag: "x"},
+		{Field: "name", Value: "x", Tag: "  "},
+	} {
+		assert.Error(t, invalid.validate(), "%+v", invalid)
+	}
+}
+
+func TestRuleTags(t *testing.T) {
+	rules := []TagRule{
+		{Field: "ext", Op: "equals", Value: "png", Tag: "image"},
+		{Field: "name", Op: "regex", Value: `(?i)^draft[-_]`, Tag: "draft"},
+		{Field: "camera", Op: "contains", Value: "iphone", Tag: "iphone"},
+		{Field: "content_type", Op: "equals", Value: "application/pdf", Tag: "document"},
+		{Field: "name", Op: "regex", Value: "(", Tag: "broken"},
+	}
+	compileRules(rules)
+	media := Media{Name: "Draft_cover", OriginalFilename: "cover.PNG", Metadata: MediaMetadata{Camera: "Apple iPhone 15 Pro"}}
+	assert.Equal(t, []Tag{{Name: "image"}, {Name: "draft"}, {Name: "iphone"}}, ruleTags(rules, media))
+	assert.Empty(t, ruleTags(rules, Media{Name: "final", OriginalFilename: "cover.jpg"}))
+}
+
+func TestRules(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/rules", func(w http.ResponseWriter, r *http.Request) { Rules(w, r, db) })
+	mux.HandleFunc("/v1/rules/{id}", func(w http.ResponseWriter, r *http.Request) { SingleRule(w, r, db) })
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/rules", bytes.NewBufferString(`{"field":"ext","value":"png","tag":"Image"}`)))
+	if status := recorder.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var rule TagRule
+	if err := json.Unmarshal(recorder.Body.Bytes(), &rule); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Equal(t, "image", rule.Tag)
+	assert.True(t, rule.Enabled)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/rules", bytes.NewBufferString(`{"field":"ext","op":"like","value":"png","tag":"image"}`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("PATCH", fmt.Sprintf("/v1/rules/%d", rule.ID), bytes.NewBufferString(`{"enabled":false,"value":"gif"}`)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var stored TagRule
+	db.First(&stored, rule.ID)
+	assert.False(t, stored.Enabled)
+	assert.Equal(t, "gif", stored.Value)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/rules", nil))
+	var rules []TagRule
+	json.Unmarshal(recorder.Body.Bytes(), &rules)
+	assert.Len(t, rules, 1)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("DELETE", fmt.Sprintf("/v1/rules/%d", rule.ID), nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/rules/%d", rule.ID), nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestUploadAppliesRules(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	previous := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previous }()
+
+	db.Create(&TagRule{Field: "ext", Op: "equals", Value: "png", Tag: "image", Enabled: true})
+	db.Create(&TagRule{Field: "name", Op: "contains", Value: "draft", Tag: "draft", Enabled: true})
+	db.Create(&TagRule{Field: "ext", Op: "equals", Value: "png", Tag: "disabled", Enabled: false})
+
+	recorder := httptest.NewRecorder()
+	AllMedia(recorder, newUploadRequest(t, map[string]string{"Name": "cover", "Tags": `[{"Name":"image"}]`}, "../static/tests/bg.png"), db)
+	if status := recorder.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var media Media
+	json.Unmarshal(recorder.Body.Bytes(), &media)
+	assert.Equal(t, []string{"image"}, mediaTagNames(media), "Expected the rule tag once, next to the one sent")
+
+	var tag Tag
+	db.Where("name = ?", "image").First(&tag)
+	assert.Equal(t, int64(1), tag.UsageCount)
+}
+
+func TestBackfillRules(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	existing := Tag{Name: "image"}
+	db.Create(&existing)
+	tagged := Media{Name: "tagged", OriginalFilename: "a.png", Tags: []*Tag{&existing}}
+	untagged := Media{Name: "untagged", OriginalFilename: "b.png"}
+	other := Media{Name: "other", OriginalFilename: "c.pdf"}
+	rejected := Media{Name: "rejected", OriginalFilename: "d.png", ProcessingStatus: processingRejected}
+	for _, media := range []*Media{&tagged, &untagged, &other, &rejected} {
+		db.Create(media)
+	}
+	recountUsage(db)
+	db.Create(&TagRule{Field: "ext", Op: "equals", Value: "png", Tag: "image", Enabled: true})
+
+	count, err := backfillRules(context.Background(), db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	var media, unmatched Media
+	db.Preload("Tags").First(&media, untagged.ID)
+	assert.Equal(t, []string{"image"}, mediaTagNames(media))
+	db.Preload("Tags").First(&unmatched, other.ID)
+	assert.Empty(t, unmatched.Tags)
+	db.Preload("Tags").First(&unmatched, rejected.ID)
+	assert.Empty(t, unmatched.Tags, "Expected rejected media to stay untagged")
+	db.First(&existing, existing.ID)
+	assert.Equal(t, int64(2), existing.UsageCount)
+
+	// running it again changes nothing
+	count, err = backfillRules(context.Background(), db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	recorder := httptest.NewRecorder()
+	RulesBackfill(recorder, httptest.NewRequest("POST", "/v1/rules/backfill", nil), db)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	var job jobs.Job
+	json.Unmarshal(recorder.Body.Bytes(), &job)
+	assert.Equal(t, fmt.Sprintf("/v1/jobs/%d", job.ID), recorder.Header().Get("Location"))
+
+	// one backfill is queued at a time
+	recorder = httptest.NewRecorder()
+	RulesBackfill(recorder, httptest.NewRequest("POST", "/v1/rules/backfill", nil), db)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	queue := jobs.NewQueue(db)
+	RegisterJobs(queue)
+	ran, err := queue.RunNext(context.Background())
+	assert.True(t, ran)
+	assert.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	RulesBackfill(recorder, httptest.NewRequest("GET", "/v1/rules/backfill", nil), db)
+	json.Unmarshal(recorder.Body.Bytes(), &job)
+	assert.Equal(t, jobs.StatusDone, job.Status)
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/bee-keeper/tags-api/scanner"
+	"github.com/bee-keeper/tags-api/storage"
+)
+
+// DefaultQuarantineRoot is where the local backend keeps quarantined files unless QUARANTINE_ROOT
+// says otherwise
+const DefaultQuarantineRoot = "../static/quarantine"
+
+// Scanner checks every upload for malware while it streams in, nil disables scanning. main sets it
+// from CLAMD_ADDR.
+var Scanner scanner.Scanner
+
+// Quarantine - backend holding uploads until their scan passes, and infected uploads for good.
+// The API never serves from it.
+var Quarantine storage.Storage = storage.NewLocal(DefaultQuarantineRoot)
+
+// errScanFailed is returned for uploads the scanner reached no verdict on, they are refused
+var errScanFailed = errors.New("malware scan failed")
+
+// contentScan - scan of content running while the content is read
+type contentScan struct {
+	pw     *io.PipeWriter
+	done   chan struct{}
+	result scanner.Result
+	err    error
+}
+
+// startScan has Scanner scan everything read through the returned reader. A scanner that gives up
+// early fails the read with errScanFailed, so content is never stored half scanned.
+func startScan(ctx context.Context, r io.Reader) (io.Reader, *contentScan) {
+	pr, pw := io.Pipe()
+	scan := &contentScan{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(scan.done)
+		scan.result, scan.err = Scanner.Scan(ctx, pr)
+		pr.CloseWithError(errScanFailed)
+	}()
+	return io.TeeReader(r, pw), scan
+}
+
+// finish ends the content, cut short by readErr if reading it failed, and waits for the verdict
+func (s *contentScan) finish(readErr error) (scanner.Result, error) {
+	if readErr != nil {
+		s.pw.CloseWithError(readErr)
+	} else {
+		s.pw.Close()
+	}
+	<-s.done
+	return s.result, s.err
+}
+
+// saveUpload stores uploaded content under key. While scanning is on the content is scanned as it
+// is written into the quarantine, and only moved into Store once it is found clean, so infected
+// content never reaches Store. Infected content is left in the quarantine and reported in the result.
+func saveUpload(ctx context.Context, content io.Reader, key string) (storage.Info, scanner.Result, error) {
+	if Scanner == nil {
+		info, err := saveFile(ctx, content, key)
+		return info, scanner.Result{}, err
+	}
+
+	scanned, scan := startScan(ctx, content)
+	info, err := Quarantine.Put(ctx, key, scanned)
+	result, scanErr := scan.finish(err)
+	// a scanner giving up fails the write too, its error tells why
+	if scanErr != nil && (err == nil || errors.Is(err, errScanFailed)) {
+		err = fmt.Errorf("%w: %v", errScanFailed, scanErr)
+	}
+	if err != nil {
+		discardQuarantined(ctx, key)
+		return storage.Info{}, scanner.Result{}, err
+	}
+	if result.Infected {
+		return info, result, nil
+	}
+	info, err = releaseFromQuarantine(ctx, key)
+	return info, result, err
+}
+
+// releaseFromQuarantine moves content found clean from the quarantine into Store under the same key
+func releaseFromQuarantine(ctx context.Context, key string) (storage.Info, error) {
+	defer discardQuarantined(ctx, key)
+	file, err := Quarantine.Get(ctx, key)
+	if err != nil {
+		return storage.Info{}, err
+	}
+	defer file.Close()
+	return saveFile(ctx, file, key)
+}
+
+// discardQuarantined removes a file from the quarantine, logging failures like discardFile
+func discardQuarantined(ctx context.Context, key string) {
+	if err := Quarantine.Delete(context.WithoutCancel(ctx), key); err != nil {
+		log.Printf("failed to remove quarantined file %q: %v", key, err)
+	}
+}
+
+// rejectionReason is what rejected media tell about the malware found in them
+func rejectionReason(result scanner.Result) string {
+	return "Malware found: " + result.Signature
+}
+
+// contentServable writes the error response for media whose content may not be served, the
+// rejected ones
+func contentServable(w http.ResponseWriter, media Media) bool {
+	if media.ProcessingStatus == processingRejected {
+		http.Error(w, "Media rejected: "+media.RejectionReason, http.StatusGone)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bee-keeper/tags-api/jobs"
+	"github.com/bee-keeper/tags-api/scanner"
+	"github.com/bee-keeper/tags-api/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeScanner finds its signature in content containing marker, or fails with err
+type fakeScanner struct {
+	marker    []byte
+	signature string
+	err       error
+}
+
+func (s fakeScanner) Scan(_ context.Context, r io.Reader) (scanner.Result, error) {
+	if s.err != nil {
+		// gives up without reading, like a daemon that can't be reached
+		return scanner.Result{}, s.err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return scanner.Result{}, err
+	}
+	if bytes.Contains(data, s.marker) {
+		return scanner.Result{Infected: true, Signature: s.signature}, nil
+	}
+	return scanner.Result{}, nil
+}
+
+// withScanner swaps the scanner and the storage backends for the duration of a test
+func withScanner(t *testing.T, s scanner.Scanner) {
+	previousScanner, previousStore, previousQuarantine := Scanner, Store, Quarantine
+	Scanner, Store, Quarantine = s, storage.NewLocal(t.TempDir()), storage.NewLocal(t.TempDir())
+	t.Cleanup(func() { Scanner, Store, Quarantine = previousScanner, previousStore, previousQuarantine })
+}
+
+// stored lists the keys kept by a backend
+func stored(t *testing.T, s storage.Storage) []string {
+	infos, err := s.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	return keys
+}
+
+func TestSaveUpload(t *testing.T) {
+	ctx := context.Background()
+	withScanner(t, fakeScanner{marker: []byte("EICAR"), signature: "Eicar"})
+
+	info, result, err := saveUpload(ctx, strings.NewReader("holiday picture"), "clean.txt")
+	assert.NoError(t, err)
+	assert.False(t, result.Infected)
+	assert.Equal(t, int64(15), info.Size)
+	assert.Equal(t, []string{"clean.txt"}, stored(t, Store))
+	assert.Empty(t, stored(t, Quarantine), "Expected clean content to leave the quarantine")
+
+	// infected content never reaches Store
+	_, result, err = saveUpload(ctx, strings.NewReader("a file with EICAR inside"), "infected.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, scanner.Result{Infected: true, Signature: "Eicar"}, result)
+	assert.Equal(t, []string{"clean.txt"}, stored(t, Store))
+	assert.Equal(t, []string{"infected.txt"}, stored(t, Quarantine))
+
+	// content without a verdict is kept nowhere
+	Scanner = fakeScanner{err: errors.New("connection refused")}
+	_, _, err = saveUpload(ctx, strings.NewReader(strings.Repeat("x", 1<<20)), "unscanned.txt")
+	assert.ErrorIs(t, err, errScanFailed)
+	assert.Equal(t, []string{"clean.txt"}, stored(t, Store))
+	assert.Equal(t, []string{"infected.txt"}, stored(t, Quarantine))
+
+	// without a scanner content goes straight to Store
+	Scanner = nil
+	_, _, err = saveUpload(ctx, strings.NewReader("EICAR"), "unchecked.txt")
+	assert.NoError(t, err)
+	assert.Contains(t, stored(t, Store), "unchecked.txt")
+}
+
+func TestContentServable(t *testing.T) {
+	for media, status := range map[*Media]int{
+		{ProcessingStatus: processingPending}:                                       http.StatusOK,
+		{ProcessingStatus: processingDone}:                                          http.StatusOK,
+		{ProcessingStatus: processingRejected, RejectionReason: "Malware found: X"}: http.StatusGone,
+	} {
+		recorder := httptest.NewRecorder()
+		if contentServable(recorder, *media) {
+			recorder.WriteHeader(http.StatusOK)
+		}
+		assert.Equal(t, status, recorder.Code, "%+v", *media)
+	}
+}
+
+func TestUploadRejectsInfected(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	withScanner(t, fakeScanner{marker: []byte("PNG"), signature: "Test-Signature"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) { AllMedia(w, r, db) })
+	mux.HandleFunc("/v1/media/{id}", func(w http.ResponseWriter, r *http.Request) { SingleMedia(w, r, db) })
+	mux.HandleFunc("/v1/media/{id}/content", func(w http.ResponseWriter, r *http.Request) { MediaContent(w, r, db) })
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "background", "Tags": `[{"Name":"cat"}]`}, "../static/tests/bg.png"))
+	if status := recorder.Code; status != http.StatusUnprocessableEntity {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+	}
+	var media Media
+	json.Unmarshal(recorder.Body.Bytes(), &media)
+	assert.Equal(t, processingRejected, media.ProcessingStatus)
+	assert.Equal(t, "Malware found: Test-Signature", media.RejectionReason)
+	assert.Empty(t, media.Tags)
+	assert.Empty(t, stored(t, Store), "Expected infected content to stay out of storage")
+	assert.Equal(t, []string{media.Path}, stored(t, Quarantine))
+
+	var queued int64
+	db.Model(&jobs.Job{}).Count(&queued)
+	assert.Zero(t, queued, "Expected rejected media not to be processed")
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/media/%d/content", media.ID), nil))
+	assert.Equal(t, http.StatusGone, recorder.Code)
+
+	// the quarantined copy goes with its media
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("DELETE", fmt.Sprintf("/v1/media/%d", media.ID), nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Empty(t, stored(t, Quarantine))
+}
+
+func TestUploadScansClean(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	withScanner(t, fakeScanner{marker: []byte("EICAR"), signature: "Eicar"})
+
+	recorder := httptest.NewRecorder()
+	AllMedia(recorder, newUploadRequest(t, map[string]string{"Name": "background", "Tags": "[]"}, "../static/tests/bg.png"), db)
+	if status := recorder.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var media Media
+	json.Unmarshal(recorder.Body.Bytes(), &media)
+	assert.NotNil(t, media.ScannedAt)
+	assert.Equal(t, processingPending, media.ProcessingStatus)
+	assert.Equal(t, []string{media.Path}, stored(t, Store))
+	assert.Empty(t, stored(t, Quarantine))
+
+	// no verdict, no upload
+	Scanner = fakeScanner{err: errors.New("connection refused")}
+	recorder = httptest.NewRecorder()
+	AllMedia(recorder, newUploadRequest(t, map[string]string{"Name": "again", "Tags": "[]"}, "../static/tests/bg.png"), db)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, []string{media.Path}, stored(t, Store))
+}
+
+func TestResumableUploadRejectsInfected(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	withScanner(t, fakeScanner{marker: []byte("PNG"), signature: "Test-Signature"})
+	data, err := os.ReadFile("../static/tests/bg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newTusMux(db)
+	req := tusRequest("POST", "/v1/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(len(data)))
+	req.Header.Set("Upload-Metadata", "name "+base64.StdEncoding.EncodeToString([]byte("background")))
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+
+	req = tusRequest("PATCH", recorder.Header().Get("Location"), data)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Test-Signature")
+
+	var media Media
+	db.Where("name = ?", "background").First(&media)
+	assert.Equal(t, fmt.Sprintf("/v1/media/%d", media.ID), recorder.Header().Get("Media-Location"))
+	assert.Equal(t, processingRejected, media.ProcessingStatus)
+	assert.Empty(t, stored(t, Store))
+	assert.Equal(t, []string{media.Path}, stored(t, Quarantine), "Expected the staged parts to be removed")
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// defaultSuggestLimit is how many suggestions GET /v1/tags/suggest returns without a limit
+const defaultSuggestLimit = 10
+
+// likeEscaper escapes the LIKE wildcards in user input
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SuggestTags - type-ahead over tag names and aliases, most used tags first. The prefix may
+// start with a namespace, e.g. "location:pa", and ?unaccent=true also ignores accents.
+func SuggestTags(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.URL.Path != "/v1/tags/suggest" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		limit := defaultSuggestLimit
+		if limitStr := query.Get("limit"); limitStr != "" {
+			n, err := strconv.Atoi(limitStr)
+			if err != nil || n < 1 || n > maxPageSize {
+				http.Error(w, fmt.Sprintf("Invalid limit, must be between 1 and %d", maxPageSize), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		unaccent, _ := strconv.ParseBool(query.Get("unaccent"))
+
+		namespace, prefix := splitTagName(query.Get("prefix"))
+		prefix = normalizeTagName(prefix)
+		if prefix == "" {
+			http.Error(w, "Prefix is required", http.StatusBadRequest)
+			return
+		}
+
+		tags, err := suggestTags(db, namespace, prefix, unaccent, limit)
+		if err != nil {
+			http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+			return
+		}
+		withMediaCounts(tags)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tags); err != nil {
+			http.Error(w, "Failed to encode tags", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// suggestTags finds the tags whose name or alias starts with a normalized prefix. Both lookups
+// go through a text_pattern_ops index on the search key, matching with accents is a filter on top.
+func suggestTags(db *gorm.DB, namespace, prefix string, unaccent bool, limit int) ([]Tag, error) {
+	keyPattern := likeEscaper.Replace(searchKey(prefix)) + "%"
+	namePattern := likeEscaper.Replace(prefix) + "%"
+
+	tagQuery := db.Where("search_key LIKE ?", keyPattern)
+	if !unaccent {
+		tagQuery = tagQuery.Where("name LIKE ?", namePattern)
+	}
+	if namespace != "" {
+		tagQuery = tagQuery.Where("namespace = ?", namespace)
+	}
+	var tags []Tag
+	if err := tagQuery.Order("usage_count DESC, length(name), name").Limit(limit).Find(&tags).Error; err != nil {
+		return nil, err
+	}
+
+	aliasQuery := db.Joins("Tag").Where("tag_aliases.search_key LIKE ?", keyPattern)
+	if !unaccent {
+		// alias names carry their namespace, the prefix applies to the part after it
+		aliasQuery = aliasQuery.Where("regexp_replace(tag_aliases.name, '^[^:]+:', '') LIKE ?", namePattern)
+	}
+	if namespace != "" {
+		aliasQuery = aliasQuery.Where("tag_aliases.name LIKE ?", likeEscaper.Replace(namespace+namespaceSeparator)+"%")
+	}
+	var aliases []TagAlias
+	if err := aliasQuery.Order(`"Tag".usage_count DESC, length(tag_aliases.name), tag_aliases.name`).Limit(limit).Find(&aliases).Error; err != nil {
+		return nil, err
+	}
+
+	// a tag matched by name wins over the same tag matched through an alias
+	seen := map[uint]bool{}
+	for _, tag := range tags {
+		seen[tag.ID] = true
+	}
+	for _, alias := range aliases {
+		if alias.Tag == nil || seen[alias.TagID] {
+			continue
+		}
+		seen[alias.TagID] = true
+		tag := *alias.Tag
+		tag.MatchedAlias = alias.Name
+		tags = append(tags, tag)
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i].UsageCount != tags[j].UsageCount {
+			return tags[i].UsageCount > tags[j].UsageCount
+		}
+		return len(suggestedName(tags[i])) < len(suggestedName(tags[j]))
+	})
+	if len(tags) > limit {
+		tags = tags[:limit]
+	}
+	return tags, nil
+}
+
+// suggestedName is the name a suggestion matched on
+func suggestedName(tag Tag) string {
+	if tag.MatchedAlias != "" {
+		return tag.MatchedAlias
+	}
+	return tag.Name
+}
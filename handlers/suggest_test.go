@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuggestTags(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	tags := []Tag{
+		{Name: "café", UsageCount: 5},
+		{Name: "cat", UsageCount: 1},
+		{Name: "car", UsageCount: 3},
+		{Name: "dog", UsageCount: 9},
+		{Name: "cairo", Namespace: "location", UsageCount: 2},
+	}
+	for i := range tags {
+		db.Create(&tags[i])
+	}
+	db.Create(&TagAlias{Name: "canine", TagID: tags[3].ID})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/suggest", func(w http.ResponseWriter, r *http.Request) { SuggestTags(w, r, db) })
+	suggest := func(query string) []Tag {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags/suggest?"+query, nil))
+		if status := recorder.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var suggestions []Tag
+		if err := json.Unmarshal(recorder.Body.Bytes(), &suggestions); err != nil {
+			t.Fatalf("could not unmarshal response body: %v", err)
+		}
+		return suggestions
+	}
+
+	// aliases are included and everything is ranked by use
+	suggestions := suggest("prefix=CA")
+	assert.Equal(t, []string{"dog", "café", "car", "cairo", "cat"}, tagNames(suggestions))
+	assert.Equal(t, "canine", suggestions[0].MatchedAlias)
+	if assert.NotNil(t, suggestions[0].MediaCount) {
+		assert.Equal(t, int64(9), *suggestions[0].MediaCount)
+	}
+
+	assert.Empty(t, suggest("prefix=cafe"), "Expected accents to matter by default")
+	assert.Equal(t, []string{"café"}, tagNames(suggest("prefix=cafe&unaccent=true")))
+	assert.Equal(t, []string{"cairo"}, tagNames(suggest("prefix=location:ca")))
+	assert.Len(t, suggest("prefix=ca&limit=2"), 2)
+	assert.Empty(t, suggest("prefix=ca%25"), "Expected LIKE wildcards to be matched literally")
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags/suggest", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+// SlugifyTags makes tag normalization also turn names into slugs, e.g. "New York!" into "new-york"
+var SlugifyTags = false
+
+// errEmptyTagName is returned for names with nothing left after normalization
+var errEmptyTagName = errors.New("Name is required")
+
+// errInvalidNamespace is returned for namespaces containing the separator
+var errInvalidNamespace = errors.New("Namespace can't contain ':'")
+
+// namespaceSeparator splits a qualified tag name like "location:paris" into namespace and name
+const namespaceSeparator = ":"
+
+// normalizeTagName maps every spelling of a tag onto one canonical name: surrounding and
+// repeated whitespace is dropped, the name is composed to Unicode NFC and case folded
+func normalizeTagName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	// folding can decompose some characters again, so compose before and after
+	name = norm.NFC.String(cases.Fold().String(norm.NFC.String(name)))
+	if SlugifyTags {
+		name = slugify(name)
+	}
+	return name
+}
+
+// slugify replaces every run of characters other than letters and digits with a single dash
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// splitTagName splits a "namespace:name" tag into its normalized namespace and the raw name,
+// names without a namespace before the first separator belong to the default namespace ""
+func splitTagName(name string) (string, string) {
+	i := strings.Index(name, namespaceSeparator)
+	if i < 0 {
+		return "", name
+	}
+	namespace, rest := normalizeTagName(name[:i]), name[i+len(namespaceSeparator):]
+	if namespace == "" || strings.TrimSpace(rest) == "" {
+		return "", name
+	}
+	return namespace, rest
+}
+
+// qualifyTagName joins a namespace and a name, leaving names in the default namespace bare
+func qualifyTagName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + namespaceSeparator + name
+}
+
+// normalizeQualifiedName normalizes a possibly namespaced name, e.g. " Artist: Foo" into "artist:foo"
+func normalizeQualifiedName(name string) string {
+	namespace, name := splitTagName(name)
+	return qualifyTagName(namespace, normalizeTagName(name))
+}
+
+// qualifiedName is the name the tag is addressed by, including its namespace
+func (t Tag) qualifiedName() string {
+	return qualifyTagName(t.Namespace, t.Name)
+}
+
+// normalize sets the canonical Namespace and Name, keeping what the client sent as the DisplayName.
+// Without an explicit Namespace one is taken from a "namespace:name" Name.
+func (t *Tag) normalize() error {
+	if t.Namespace != "" {
+		t.Namespace = normalizeTagName(t.Namespace)
+		if strings.Contains(t.Namespace, namespaceSeparator) {
+			return errInvalidNamespace
+		}
+	} else {
+		t.Namespace, t.Name = splitTagName(t.Name)
+	}
+	display := strings.Join(strings.Fields(t.DisplayName), " ")
+	if display == "" {
+		display = strings.Join(strings.Fields(t.Name), " ")
+	}
+	t.Name = normalizeTagName(t.Name)
+	if t.Name == "" {
+		return errEmptyTagName
+	}
+	t.DisplayName = display
+	return nil
+}
+
+// searchKey strips the accents from a normalized name, so "cafe" finds "café" in suggestions
+func searchKey(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(name) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+	return norm.NFC.String(b.String())
+}
+
+// BeforeSave keeps the search key in step with the name
+func (t *Tag) BeforeSave(tx *gorm.DB) error {
+	if t.Name != "" {
+		t.SearchKey = searchKey(t.Name)
+	}
+	return nil
+}
+
+// whereTagName restricts a tag query to the tag with a normalized qualified name
+func whereTagName(db *gorm.DB, qualified string) *gorm.DB {
+	namespace, name := splitTagName(qualified)
+	return db.Where("namespace = ? AND name = ?", namespace, name)
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeTagName(t *testing.T) {
+	cases := map[string]string{
+		"cat":        "cat",
+		"  Cat ":     "cat",
+		"CAT":        "cat",
+		"New   York": "new york",
+		"Straße":     "strasse",
+		"Cafe\u0301": "café",
+		"café":       "café",
+		"\t\n":       "",
+		"ΣΊΣΥΦΟΣ":    "σίσυφοσ",
+		"Déjà Vu":    "déjà vu",
+	}
+	for in, expected := range cases {
+		assert.Equal(t, expected, normalizeTagName(in), "normalizing %q", in)
+	}
+}
+
+func TestNormalizeTagNameSlugs(t *testing.T) {
+	SlugifyTags = true
+	defer func() { SlugifyTags = false }()
+
+	cases := map[string]string{
+		"New York!":     "new-york",
+		"  rock & roll": "rock-roll",
+		"Déjà Vu":       "déjà-vu",
+		"--":            "",
+	}
+	for in, expected := range cases {
+		assert.Equal(t, expected, normalizeTagName(in), "normalizing %q", in)
+	}
+}
+
+func TestTagNormalizeKeepsDisplayName(t *testing.T) {
+	tag := Tag{Name: "  New  York "}
+	assert.NoError(t, tag.normalize())
+	assert.Equal(t, "new york", tag.Name)
+	assert.Equal(t, "New York", tag.DisplayName)
+
+	empty := Tag{Name: "   "}
+	assert.ErrorIs(t, empty.normalize(), errEmptyTagName)
+}
+
+func TestCreateTagCaseInsensitiveDupe(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags", func(w http.ResponseWriter, r *http.Request) {
+		Tags(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/tags", bytes.NewBufferString(`{"Name":"Cat"}`)))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var respTag Tag
+	if err := json.Unmarshal(recorder.Body.Bytes(), &respTag); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	assert.Equal(t, "cat", respTag.Name)
+	assert.Equal(t, "Cat", respTag.DisplayName)
+
+	for _, name := range []string{"cat", "cat ", "CAT"} {
+		recorder = httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/tags", bytes.NewBufferString(`{"Name":"`+name+`"}`)))
+		assert.Equal(t, http.StatusConflict, recorder.Code, "creating %q", name)
+	}
+
+	// the database refuses case variants even when the handler is bypassed
+	assert.Error(t, db.Create(&Tag{Name: "CAT"}).Error)
+}
+
+func TestUploadNormalizesTags(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	db.Create(&Tag{Name: "cat", DisplayName: "Cat"})
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		AllMedia(w, r, db)
+	})
+	mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "media1", "Tags": `[{"Name":"CAT "}, {"Name":"Garden"}]`}, "../static/tests/bg.png"))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var count int64
+	db.Model(&Tag{}).Count(&count)
+	assert.Equal(t, int64(2), count, "Expected CAT to reuse the existing cat tag")
+
+	var garden Tag
+	db.Where("name = ?", "garden").First(&garden)
+	assert.Equal(t, "Garden", garden.DisplayName)
+}
+
+func TestSplitTagName(t *testing.T) {
+	cases := map[string][2]string{
+		"location:paris":    {"location", "paris"},
+		" Artist : Foo":     {"artist", " Foo"},
+		"paris":             {"", "paris"},
+		":paris":            {"", ":paris"},
+		"paris:":            {"", "paris:"},
+		"time:12:30":        {"time", "12:30"},
+		"  :  ":             {"", "  :  "},
+		"Location:Île Cité": {"location", "Île Cité"},
+	}
+	for in, expected := range cases {
+		namespace, name := splitTagName(in)
+		assert.Equal(t, expected, [2]string{namespace, name}, "splitting %q", in)
+	}
+
+	tag := Tag{Name: "Location: New  York"}
+	assert.NoError(t, tag.normalize())
+	assert.Equal(t, "location", tag.Namespace)
+	assert.Equal(t, "new york", tag.Name)
+	assert.Equal(t, "New York", tag.DisplayName)
+	assert.Equal(t, "location:new york", tag.qualifiedName())
+
+	invalid := Tag{Namespace: "a:b", Name: "c"}
+	assert.ErrorIs(t, invalid.normalize(), errInvalidNamespace)
+}
+
+func TestSearchKey(t *testing.T) {
+	cases := map[string]string{
+		"café":     "cafe",
+		"déjà vu":  "deja vu",
+		"σίσυφοσ":  "σισυφοσ",
+		"new york": "new york",
+	}
+	for in, expected := range cases {
+		assert.Equal(t, expected, searchKey(in), "keying %q", in)
+	}
+}
+
+func TestNormalizeTagNamesMergesCaseDuplicates(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	// tags saved before names were case folded
+	db.Exec("DROP INDEX idx_tags_namespace_name_ci")
+	var ids []uint
+	for _, name := range []string{"Cat", "cat", "CAT", "Dog"} {
+		var id uint
+		db.Raw("INSERT INTO tags (created_at, updated_at, name, display_name) VALUES (now(), now(), ?, '') RETURNING id", name).Scan(&id)
+		ids = append(ids, id)
+	}
+	first := Media{Name: "first"}
+	second := Media{Name: "second"}
+	db.Create(&first)
+	db.Create(&second)
+	db.Exec("INSERT INTO media_tags (media_id, tag_id) VALUES (?, ?), (?, ?), (?, ?)", first.ID, ids[0], first.ID, ids[1], second.ID, ids[2])
+	db.Create(&TagAlias{Name: "kitty", TagID: ids[2]})
+
+	assert.NoError(t, db.Transaction(normalizeTagNames))
+
+	var tags []Tag
+	db.Order("id").Find(&tags)
+	if assert.Len(t, tags, 2) {
+		assert.Equal(t, ids[0], tags[0].ID, "Expected the oldest tag to be kept")
+		assert.Equal(t, "cat", tags[0].Name)
+		assert.Equal(t, "Cat", tags[0].DisplayName)
+		assert.Equal(t, int64(2), tags[0].UsageCount)
+	}
+	var alias TagAlias
+	db.Where("name = ?", "kitty").First(&alias)
+	assert.Equal(t, ids[0], alias.TagID)
+
+	// the database refuses case variants again
+	assert.Error(t, db.Exec("INSERT INTO tags (created_at, updated_at, name) VALUES (now(), now(), 'DOG')").Error)
+}
@@ -2,15 +2,33 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// Tag - data representation
+// Tag - data representation, Name is normalized and unique ignoring case within its Namespace while
+// DisplayName keeps the spelling it was created with
 type Tag struct {
 	gorm.Model
-	Name string `json:"name" gorm:"unique"`
+	Namespace   string `json:"namespace" gorm:"not null;default:''"`
+	Name        string `json:"name" gorm:"not null"`
+	DisplayName string `json:"display_name"`
+	SearchKey   string `json:"-" gorm:"not null;default:''"`
+	// ParentID places the tag under another one, nil for top level tags
+	ParentID *uint `json:"parent_id" gorm:"index"`
+	Parent   *Tag  `json:"-" gorm:"constraint:OnDelete:SET NULL"`
+	// UsageCount is the number of media carrying the tag, kept up to date as media change
+	UsageCount int64 `json:"-" gorm:"not null;default:0;index"`
+	// MediaCount exposes UsageCount when the client asks for counts
+	MediaCount *int64 `json:"media_count,omitempty" gorm:"-"`
+	// MatchedAlias is set when the tag was reached through one of its aliases
+	MatchedAlias string `json:"matched_alias,omitempty" gorm:"-"`
 }
 
 // Tags - HTTP methods for tag operations
@@ -22,12 +40,45 @@ func Tags(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 
 	switch r.Method {
 	case http.MethodGet:
-		var tags []Tag
+		p, err := parsePage(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// optionally only the tags of one namespace
+		scope := db
+		if query := r.URL.Query(); query.Has("namespace") {
+			scope = db.Where("namespace = ?", normalizeTagName(query.Get("namespace")))
+		}
+
+		var total int64
+		if result := scope.Model(&Tag{}).Count(&total); result.Error != nil {
+			http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+			return
+		}
+
+		query, err := p.apply(scope, "tags")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tags := []Tag{}
 		// fetch tags
-		if result := db.Find(&tags); result.Error != nil {
+		if result := query.Find(&tags); result.Error != nil {
 			http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
 			return
 		}
+		next := ""
+		if len(tags) > p.limit {
+			tags = tags[:p.limit]
+			next = p.nextCursor(tags[p.limit-1].Name, tags[p.limit-1].Model)
+		}
+		if wantsCounts(r) {
+			withMediaCounts(tags)
+		}
+		writePageHeaders(w, r, total, next)
+
 		// list tags
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(tags); err != nil {
@@ -41,14 +92,39 @@ func Tags(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 			http.Error(w, "Invalid input", http.StatusBadRequest)
 			return
 		}
-		// check existing tags
-		var existingTag Tag
-		if result := db.Where("name = ?", tag.Name).First(&existingTag); result.RowsAffected > 0 {
-			http.Error(w, "Tag with this name already exists", http.StatusConflict)
+		if err := tag.normalize(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if taken, err := aliasExists(db, tag.qualifiedName()); err != nil || taken {
+			if err != nil {
+				http.Error(w, "Failed to create tag", http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, "Alias with this name already exists", http.StatusConflict)
 			return
 		}
-		// create tag
-		if result := db.Create(&tag); result.Error != nil {
+		tag.Parent = nil
+		// create tag, the unique index decides between concurrent requests for the same name
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := setParent(tx, &tag, tag.ParentID); err != nil {
+				return err
+			}
+			created, err := insertTag(tx, &tag)
+			if err == nil && !created {
+				return errTagExists
+			}
+			return err
+		})
+		if err != nil {
+			if errors.Is(err, errParentNotFound) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, errTagExists) || isUniqueViolation(err) {
+				http.Error(w, "Tag with this name already exists", http.StatusConflict)
+				return
+			}
 			http.Error(w, "Failed to create tag", http.StatusInternalServerError)
 			return
 		}
@@ -66,3 +142,227 @@ func Tags(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// SingleTag - HTTP methods for operations on one tag, addressed by ID or name
+func SingleTag(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	idOrName := r.PathValue("id")
+	if idOrName == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var tag Tag
+		if !loadTag(w, db, idOrName, &tag) {
+			return
+		}
+		if wantsCounts(r) {
+			count := tag.UsageCount
+			tag.MediaCount = &count
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tag); err != nil {
+			http.Error(w, "Failed to encode tag", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPut, http.MethodPatch:
+		var tag Tag
+		if !loadTag(w, db, idOrName, &tag) {
+			return
+		}
+
+		var patch struct {
+			Namespace   *string    `json:"namespace"`
+			Name        *string    `json:"name"`
+			DisplayName *string    `json:"display_name"`
+			ParentID    optionalID `json:"parent_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		// PUT replaces the whole tag, so the name is mandatory
+		if r.Method == http.MethodPut && patch.Name == nil {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+
+		updated := tag
+		// PUT without a namespace moves the tag to the default one
+		if patch.Namespace != nil {
+			updated.Namespace = *patch.Namespace
+		} else if r.Method == http.MethodPut {
+			updated.Namespace = ""
+		}
+		if patch.Name != nil {
+			// a namespace spelled out in the name wins over the current one
+			if namespace, _ := splitTagName(*patch.Name); namespace != "" {
+				updated.Namespace = ""
+			}
+			updated.Name = *patch.Name
+			updated.DisplayName = ""
+			if patch.DisplayName != nil {
+				updated.DisplayName = *patch.DisplayName
+			}
+			if err := updated.normalize(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else {
+			if patch.Namespace != nil {
+				updated.Namespace = normalizeTagName(updated.Namespace)
+				if strings.Contains(updated.Namespace, namespaceSeparator) {
+					http.Error(w, errInvalidNamespace.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if patch.DisplayName != nil {
+				updated.DisplayName = strings.Join(strings.Fields(*patch.DisplayName), " ")
+				if updated.DisplayName == "" {
+					http.Error(w, "Display name can't be empty", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		// PUT without a parent moves the tag to the top level
+		parentChanged := false
+		if patch.ParentID.Set || r.Method == http.MethodPut {
+			parentChanged = !sameID(tag.ParentID, patch.ParentID.ID)
+		}
+
+		if updated != tag || parentChanged {
+			// check existing tags
+			var existingTag Tag
+			if result := whereTagName(db, updated.qualifiedName()).Where("id <> ?", tag.ID).First(&existingTag); result.RowsAffected > 0 {
+				http.Error(w, "Tag with this name already exists", http.StatusConflict)
+				return
+			}
+			if taken, err := aliasExists(db, updated.qualifiedName()); err != nil || taken {
+				if err != nil {
+					http.Error(w, "Failed to update tag", http.StatusInternalServerError)
+					return
+				}
+				http.Error(w, "Alias with this name already exists", http.StatusConflict)
+				return
+			}
+			tag = updated
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if parentChanged {
+					if err := setParent(tx, &tag, patch.ParentID.ID); err != nil {
+						return err
+					}
+				}
+				// the count is maintained by media changes, saving the loaded value could undo one
+				return tx.Omit("usage_count").Save(&tag).Error
+			})
+			if err != nil {
+				switch {
+				case errors.Is(err, errParentNotFound):
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				case errors.Is(err, errTagCycle):
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				// a concurrent rename may still win the race to the unique index
+				if isUniqueViolation(err) {
+					http.Error(w, "Tag with this name already exists", http.StatusConflict)
+					return
+				}
+				http.Error(w, "Failed to update tag", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tag); err != nil {
+			http.Error(w, "Failed to encode tag", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodDelete:
+		var tag Tag
+		if !loadTag(w, db, idOrName, &tag) {
+			return
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// detach the tag from all media before removing it
+			if err := tx.Exec("DELETE FROM media_tags WHERE tag_id = ?", tag.ID).Error; err != nil {
+				return err
+			}
+			// children move up to the deleted tag's parent instead of becoming top level
+			if err := tx.Model(&Tag{}).Where("parent_id = ?", tag.ID).Update("parent_id", tag.ParentID).Error; err != nil {
+				return err
+			}
+			// hard delete, otherwise the soft deleted row keeps holding the unique name
+			return tx.Unscoped().Delete(&tag).Error
+		})
+		if err != nil {
+			http.Error(w, "Failed to delete tag", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// errTagExists is returned when a tag with the same name is already stored
+var errTagExists = errors.New("Tag with this name already exists")
+
+// insertTag creates the tag unless its name is taken, in one statement so concurrent inserts
+// of the same name can't fail. It reports whether the tag was created.
+func insertTag(db *gorm.DB, tag *Tag) (bool, error) {
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "namespace"}, {Name: "lower(name)", Raw: true}},
+		DoNothing: true,
+	}).Create(tag)
+	return result.RowsAffected > 0, result.Error
+}
+
+// findTag looks a tag up by numeric ID, falling back to its name, which may include a namespace
+func findTag(db *gorm.DB, idOrName string, tag *Tag) error {
+	if id, err := strconv.ParseUint(idOrName, 10, 32); err == nil {
+		err := db.First(tag, uint(id)).Error
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+	}
+	return whereTagName(db, normalizeQualifiedName(idOrName)).First(tag).Error
+}
+
+// loadTag fetches a tag for an item route, writing the error response if it can't
+func loadTag(w http.ResponseWriter, db *gorm.DB, idOrName string, tag *Tag) bool {
+	if err := findTag(db, idOrName, tag); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Tag not found", http.StatusNotFound)
+			return false
+		}
+		http.Error(w, "Failed to fetch tag", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// sameID reports whether two optional IDs are equal
+func sameID(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// isUniqueViolation reports whether err was raised by a unique index or constraint
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
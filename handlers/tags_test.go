@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -216,3 +217,147 @@ func TestDefaultHandlerMethod(t *testing.T) {
 	assert.Equal(t, "GET, POST, OPTIONS", allowHeader)
 	assert.Contains(t, recorder.Body.String(), "method not allowed")
 }
+
+func TestGetTagByIDAndName(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	tag := Tag{Name: "tag1"}
+	if result := db.Create(&tag); result.Error != nil {
+		t.Fatalf("Failed to create tag: %v", result.Error)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleTag(w, r, db)
+	})
+
+	for _, key := range []string{strconv.FormatUint(uint64(tag.ID), 10), "tag1"} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/tags/"+key, nil)
+		mux.ServeHTTP(recorder, req)
+
+		if status := recorder.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+
+		var respTag Tag
+		if err := json.Unmarshal(recorder.Body.Bytes(), &respTag); err != nil {
+			t.Fatalf("could not unmarshal response body: %v", err)
+		}
+		assert.Equal(t, tag.ID, respTag.ID)
+		assert.Equal(t, "tag1", respTag.Name)
+	}
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags/missing", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestRenameTag(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	tag := Tag{Name: "tag1"}
+	if result := db.Create(&tag); result.Error != nil {
+		t.Fatalf("Failed to create tag: %v", result.Error)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleTag(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPatch, "/v1/tags/tag1", bytes.NewBufferString(`{"name":"renamed"}`))
+	mux.ServeHTTP(recorder, req)
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var stored Tag
+	db.First(&stored, tag.ID)
+	assert.Equal(t, "renamed", stored.Name)
+
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPut, "/v1/tags/renamed", bytes.NewBufferString(`{}`))
+	mux.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestRenameTagConflict(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	result := db.Create([]Tag{{Name: "tag1"}, {Name: "tag2"}})
+	if result.Error != nil {
+		t.Fatalf("Failed to create tags: %v", result.Error)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleTag(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/v1/tags/tag1", bytes.NewBufferString(`{"name":"tag2"}`))
+	mux.ServeHTTP(recorder, req)
+
+	if status := recorder.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusConflict)
+	}
+	assert.Equal(t, "Tag with this name already exists\n", recorder.Body.String())
+}
+
+func TestDeleteTag(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	tag1 := Tag{Name: "tag1"}
+	tag2 := Tag{Name: "tag2"}
+	db.Create(&tag1)
+	db.Create(&tag2)
+	media := Media{Name: "media1", Path: "../static/uploads/fgggff5fgf_bg.png", Tags: []*Tag{&tag1, &tag2}}
+	if result := db.Create(&media); result.Error != nil {
+		t.Fatalf("Failed to create media: %v", result.Error)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleTag(w, r, db)
+	})
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/v1/tags/"+strconv.FormatUint(uint64(tag1.ID), 10), nil)
+	mux.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	var count int64
+	db.Unscoped().Model(&Tag{}).Where("id = ?", tag1.ID).Count(&count)
+	assert.Equal(t, int64(0), count, "Expected tag to be removed")
+
+	var stored Media
+	db.Preload("Tags").First(&stored, media.ID)
+	assert.Len(t, stored.Tags, 1, "Expected media to keep only tag2")
+	assert.Equal(t, "tag2", stored.Tags[0].Name)
+}
+
+func TestSingleTagOptionsHandler(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	recorder := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SingleTag(w, r, db)
+	})
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodOptions, "/v1/tags/1", nil))
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, "GET, PUT, PATCH, DELETE, OPTIONS", recorder.Header().Get("Allow"))
+}
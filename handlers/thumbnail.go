@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // GIFs are decoded to their first frame
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bee-keeper/tags-api/storage"
+	"gorm.io/gorm"
+)
+
+// maxThumbnailSize caps the width and height of a rendition
+const maxThumbnailSize = 2048
+
+// maxDecodeSize caps the memory an image renditions are made of takes once decoded, resampling
+// it takes little more than the rendition
+const maxDecodeSize = 128 << 20
+
+// Fits of a rendition into its box
+const (
+	// fitContain scales the image to fit inside the box, keeping its aspect ratio
+	fitContain = "contain"
+	// fitCover scales the image to cover the box and crops what sticks out around the center
+	fitCover = "cover"
+	// fitFill stretches the image to the box
+	fitFill = "fill"
+)
+
+var errNotThumbnailable = errors.New("Thumbnails are only available for PNG, JPEG and GIF images")
+
+var errImageTooLarge = errors.New("Image too large for a thumbnail")
+
+// thumbnailFormats maps the content types renditions can be made of onto the format they are encoded in,
+// JPEG stays JPEG and everything else becomes PNG to keep transparency
+var thumbnailFormats = map[string]string{
+	"image/png":  "png",
+	"image/gif":  "png",
+	"image/jpeg": "jpeg",
+}
+
+// ThumbnailSpec - size and fit of a rendition, a zero width or height follows the aspect ratio
+type ThumbnailSpec struct {
+	Width  int
+	Height int
+	Fit    string
+}
+
+// ThumbnailSizes are the renditions generated when an image is processed after upload, main sets them from THUMBNAIL_SIZES
+var ThumbnailSizes []ThumbnailSpec
+
+// ThumbnailDecodes caps how many images are decoded for renditions at once, as each can take up to
+// maxDecodeSize and a rendition of up to 16 MiB. main sets it from THUMBNAIL_DECODES.
+var ThumbnailDecodes = 4
+
+// decodeSlots has a slot for every image being decoded, it is made with ThumbnailDecodes slots on
+// first use
+var (
+	decodeSlots     chan struct{}
+	decodeSlotsOnce sync.Once
+)
+
+// acquireDecodeSlot waits for a free decode slot, the returned function gives it back
+func acquireDecodeSlot(ctx context.Context) (func(), error) {
+	decodeSlotsOnce.Do(func() { decodeSlots = make(chan struct{}, max(ThumbnailDecodes, 1)) })
+	select {
+	case decodeSlots <- struct{}{}:
+		return func() { <-decodeSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// decodedPixelSize is how many bytes a pixel of the color model takes once decoded, JPEGs count
+// as if their chroma weren't subsampled
+func decodedPixelSize(model color.Model) int64 {
+	if _, ok := model.(color.Palette); ok {
+		return 1
+	}
+	switch model {
+	case color.GrayModel:
+		return 1
+	case color.Gray16Model:
+		return 2
+	case color.YCbCrModel:
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	return 4
+}
+
+func (s ThumbnailSpec) String() string {
+	return fmt.Sprintf("%dx%d-%s", s.Width, s.Height, s.Fit)
+}
+
+// newThumbnailSpec checks the size and fit of a rendition, the fit defaults to contain
+func newThumbnailSpec(width, height, fit string) (ThumbnailSpec, error) {
+	spec := ThumbnailSpec{Fit: fit}
+	for _, dim := range []struct {
+		name  string
+		value string
+		dest  *int
+	}{{"width", width, &spec.Width}, {"height", height, &spec.Height}} {
+		if dim.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(dim.value)
+		if err != nil || n < 0 || n > maxThumbnailSize {
+			return spec, fmt.Errorf("Invalid %s, must be between 0 and %d", dim.name, maxThumbnailSize)
+		}
+		*dim.dest = n
+	}
+	if spec.Width == 0 && spec.Height == 0 {
+		return spec, errors.New("A width or height is required")
+	}
+	switch spec.Fit {
+	case "":
+		spec.Fit = fitContain
+	case fitContain, fitCover, fitFill:
+	default:
+		return spec, fmt.Errorf("Invalid fit %q, must be contain, cover or fill", spec.Fit)
+	}
+	// only both sides make a box to cover or fill
+	if spec.Width == 0 || spec.Height == 0 {
+		spec.Fit = fitContain
+	}
+	return spec, nil
+}
+
+// thumbnailParams reads the w, h and fit query parameters
+func thumbnailParams(query url.Values) (ThumbnailSpec, error) {
+	return newThumbnailSpec(query.Get("w"), query.Get("h"), query.Get("fit"))
+}
+
+// ParseThumbnailSizes reads a comma separated list of renditions such as "200x200:cover,640x0"
+func ParseThumbnailSizes(sizes string) ([]ThumbnailSpec, error) {
+	var specs []ThumbnailSpec
+	for _, size := range strings.Split(sizes, ",") {
+		size = strings.TrimSpace(size)
+		if size == "" {
+			continue
+		}
+		dims, fit, _ := strings.Cut(size, ":")
+		width, height, ok := strings.Cut(dims, "x")
+		if !ok {
+			return nil, fmt.Errorf("invalid thumbnail size %q, expected WIDTHxHEIGHT[:fit]", size)
+		}
+		spec, err := newThumbnailSpec(width, height, fit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid thumbnail size %q: %w", size, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// thumbnailGeometry works out the size of a rendition and the part of the source it shows.
+// Renditions are never larger than their source.
+func thumbnailGeometry(srcW, srcH int, spec ThumbnailSpec) (int, int, image.Rectangle) {
+	full := image.Rect(0, 0, srcW, srcH)
+	sx, sy := float64(spec.Width)/float64(srcW), float64(spec.Height)/float64(srcH)
+	switch {
+	case spec.Width == 0:
+		sx = sy
+	case spec.Height == 0:
+		sy = sx
+	}
+	scaled := func(n int, s float64) int {
+		return max(1, int(math.Round(float64(n)*s)))
+	}
+
+	switch spec.Fit {
+	case fitFill:
+		return min(spec.Width, srcW), min(spec.Height, srcH), full
+	case fitCover:
+		s := math.Min(math.Max(sx, sy), 1)
+		cropW := min(srcW, scaled(spec.Width, 1/s))
+		cropH := min(srcH, scaled(spec.Height, 1/s))
+		x0, y0 := (srcW-cropW)/2, (srcH-cropH)/2
+		return min(spec.Width, scaled(cropW, s)), min(spec.Height, scaled(cropH, s)), image.Rect(x0, y0, x0+cropW, y0+cropH)
+	default:
+		s := math.Min(math.Min(sx, sy), 1)
+		return scaled(srcW, s), scaled(srcH, s), full
+	}
+}
+
+// renditionPrefix is where the renditions of a media's content are kept, they are shared by every
+// Media with the same content
+func renditionPrefix(media Media) string {
+	source := media.SHA256
+	if source == "" {
+		// media without a content hash own their file, whose name is unique
+		source = "file-" + sanitizeString(path.Base(media.Path))
+	}
+	return "renditions/" + source + "/"
+}
+
+// thumbnailFormat is the format renditions of the media are encoded in
+func thumbnailFormat(media Media) (string, error) {
+	format, ok := thumbnailFormats[baseMediaType(media.ContentType)]
+	if !ok {
+		return "", errNotThumbnailable
+	}
+	return format, nil
+}
+
+// renditionKey is the storage key of one rendition of the media
+func renditionKey(media Media, spec ThumbnailSpec, format string) string {
+	ext := ".png"
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+	return renditionPrefix(media) + spec.String() + ext
+}
+
+// ensureRendition returns the stored rendition of the media, generating it on first use
+func ensureRendition(ctx context.Context, media Media, spec ThumbnailSpec) (storage.Info, error) {
+	if media.ContentType == "" {
+		// media uploaded before content types were recorded are sniffed
+		file, err := Store.Get(ctx, media.Path)
+		if err != nil {
+			return storage.Info{}, err
+		}
+		media.ContentType, err = sniffContentType(file)
+		file.Close()
+		if err != nil {
+			return storage.Info{}, err
+		}
+	}
+	format, err := thumbnailFormat(media)
+	if err != nil {
+		return storage.Info{}, err
+	}
+	key := renditionKey(media, spec, format)
+	info, err := Store.Stat(ctx, key)
+	if err == nil || !errors.Is(err, storage.ErrNotExist) {
+		return info, err
+	}
+
+	file, err := Store.Get(ctx, media.Path)
+	if err != nil {
+		return storage.Info{}, err
+	}
+	defer file.Close()
+	// the header tells the image size before any pixels are decoded
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return storage.Info{}, fmt.Errorf("%w: %v", errNotThumbnailable, err)
+	}
+	// in int64 the product can't overflow on 32-bit platforms
+	if config.Width <= 0 || config.Height <= 0 ||
+		int64(config.Width)*int64(config.Height)*decodedPixelSize(config.ColorModel) > maxDecodeSize {
+		return storage.Info{}, errImageTooLarge
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return storage.Info{}, err
+	}
+	buf, err := renderRendition(ctx, file, spec, format)
+	if err != nil {
+		return storage.Info{}, err
+	}
+	// concurrent requests for a new rendition write the same bytes to the same key
+	return Store.Put(ctx, key, buf)
+}
+
+// renderRendition decodes an image and encodes its rendition, holding a decode slot while the
+// decoded pixels are in memory
+func renderRendition(ctx context.Context, file io.Reader, spec ThumbnailSpec, format string) (*bytes.Buffer, error) {
+	release, err := acquireDecodeSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotThumbnailable, err)
+	}
+
+	bounds := src.Bounds()
+	width, height, crop := thumbnailGeometry(bounds.Dx(), bounds.Dy(), spec)
+	thumb := resample(src, crop.Add(bounds.Min), width, height)
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// generateRenditions makes the ThumbnailSizes renditions of an image ahead of their first request
+func generateRenditions(ctx context.Context, media Media) error {
+	if _, err := thumbnailFormat(media); err != nil {
+		return nil
+	}
+	for _, spec := range ThumbnailSizes {
+		if _, err := ensureRendition(ctx, media, spec); err != nil {
+			return fmt.Errorf("%s rendition: %w", spec, err)
+		}
+	}
+	return nil
+}
+
+// discardRenditions removes the renditions of content that is no longer stored
+func discardRenditions(ctx context.Context, media Media) {
+	renditions, err := Store.List(context.WithoutCancel(ctx), renditionPrefix(media))
+	if err != nil {
+		log.Printf("failed to list renditions of media %d: %v", media.ID, err)
+		return
+	}
+	for _, rendition := range renditions {
+		discardFile(ctx, rendition.Key)
+	}
+}
+
+// MediaThumbnail - serves a resized rendition of an image, ?w= and ?h= give its box and ?fit=contain,
+// cover or fill how it fills it
+func MediaThumbnail(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		spec, err := thumbnailParams(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var media Media
+		if err := db.First(&media, uint(id)).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "Media not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+			return
+		}
+		if !contentServable(w, media) {
+			return
+		}
+
+		info, err := ensureRendition(r.Context(), media, spec)
+		switch {
+		case errors.Is(err, errNotThumbnailable):
+			http.Error(w, errNotThumbnailable.Error(), http.StatusUnsupportedMediaType)
+			return
+		case errors.Is(err, errImageTooLarge):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case errors.Is(err, storage.ErrNotExist) || errors.Is(err, storage.ErrInvalidKey):
+			http.Error(w, "Media content not found", http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, "Failed to generate thumbnail", http.StatusInternalServerError)
+			return
+		}
+
+		file, err := Store.Get(r.Context(), info.Key)
+		if err != nil {
+			http.Error(w, "Failed to open thumbnail", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		contentType := "image/png"
+		if path.Ext(info.Key) == ".jpg" {
+			contentType = "image/jpeg"
+		}
+		w.Header().Set("Content-Type", contentType)
+		// renditions are derived from immutable content, the key names them exactly
+		w.Header().Set("ETag", `"`+strings.ReplaceAll(strings.TrimPrefix(info.Key, "renditions/"), "/", "-")+`"`)
+		http.ServeContent(w, r, path.Base(info.Key), info.ModTime, file)
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bee-keeper/tags-api/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThumbnailGeometry(t *testing.T) {
+	tests := []struct {
+		spec       ThumbnailSpec
+		w, h       int
+		crop       image.Rectangle
+		srcW, srcH int
+	}{
+		{ThumbnailSpec{200, 200, fitContain}, 200, 100, image.Rect(0, 0, 800, 400), 800, 400},
+		{ThumbnailSpec{0, 100, fitContain}, 200, 100, image.Rect(0, 0, 800, 400), 800, 400},
+		{ThumbnailSpec{200, 200, fitCover}, 200, 200, image.Rect(200, 0, 600, 400), 800, 400},
+		{ThumbnailSpec{200, 200, fitFill}, 200, 200, image.Rect(0, 0, 800, 400), 800, 400},
+		// never upscaled
+		{ThumbnailSpec{1000, 1000, fitContain}, 800, 400, image.Rect(0, 0, 800, 400), 800, 400},
+		{ThumbnailSpec{1000, 300, fitCover}, 800, 300, image.Rect(0, 50, 800, 350), 800, 400},
+	}
+	for _, test := range tests {
+		w, h, crop := thumbnailGeometry(test.srcW, test.srcH, test.spec)
+		assert.Equal(t, test.w, w, test.spec.String())
+		assert.Equal(t, test.h, h, test.spec.String())
+		assert.Equal(t, test.crop, crop, test.spec.String())
+	}
+}
+
+func TestParseThumbnailSizes(t *testing.T) {
+	sizes, err := ParseThumbnailSizes("200x200:cover, 640x0,")
+	assert.NoError(t, err)
+	assert.Equal(t, []ThumbnailSpec{{200, 200, fitCover}, {640, 0, fitContain}}, sizes)
+
+	for _, invalid := range []string{"200", "0x0", "200x200:stretch", "5000x10", "-1x10"} {
+		_, err := ParseThumbnailSizes(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestResample(t *testing.T) {
+	// left half black, right half white
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			c := color.RGBA{0, 0, 0, 255}
+			if x >= 2 {
+				c = color.RGBA{255, 255, 255, 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	out := resample(src, src.Bounds(), 2, 1)
+	assert.Equal(t, color.RGBA{0, 0, 0, 255}, out.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{255, 255, 255, 255}, out.RGBAAt(1, 0))
+
+	out = resample(src, src.Bounds(), 1, 1)
+	assert.Equal(t, color.RGBA{128, 128, 128, 255}, out.RGBAAt(0, 0))
+
+	out = resample(src, image.Rect(1, 0, 3, 2), 1, 1)
+	assert.Equal(t, color.RGBA{128, 128, 128, 255}, out.RGBAAt(0, 0))
+}
+
+func TestEnsureRendition(t *testing.T) {
+	previous := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previous }()
+	ctx := context.Background()
+
+	file, err := os.Open("../static/tests/bg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := saveFile(ctx, file, "bg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	media := Media{Path: info.Key, SHA256: "abc123", ContentType: "image/png"}
+
+	rendition, err := ensureRendition(ctx, media, ThumbnailSpec{64, 64, fitCover})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "renditions/abc123/64x64-cover.png", rendition.Key)
+	stored, _ := Store.Get(ctx, rendition.Key)
+	thumb, err := png.DecodeConfig(stored)
+	stored.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 64, thumb.Width)
+	assert.Equal(t, 64, thumb.Height)
+
+	// the stored rendition is reused
+	again, err := ensureRendition(ctx, media, ThumbnailSpec{64, 64, fitCover})
+	assert.NoError(t, err)
+	assert.Equal(t, rendition.ModTime, again.ModTime)
+
+	media.ContentType = "application/pdf"
+	_, err = ensureRendition(ctx, media, ThumbnailSpec{64, 64, fitCover})
+	assert.ErrorIs(t, err, errNotThumbnailable)
+
+	// legacy media without a content type are sniffed
+	media.ContentType = ""
+	_, err = ensureRendition(ctx, media, ThumbnailSpec{32, 0, fitContain})
+	assert.NoError(t, err)
+
+	discardRenditions(ctx, media)
+	renditions, _ := Store.List(ctx, "renditions/")
+	assert.Empty(t, renditions)
+}
+
+func TestEnsureRenditionTooLarge(t *testing.T) {
+	previous := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previous }()
+	ctx := context.Background()
+
+	// a PNG header claiming 65536x65536 pixels, a product overflowing 32 bits
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:], 1<<16)
+	binary.BigEndian.PutUint32(data[20:], 1<<16)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	info, err := saveFile(ctx, bytes.NewReader(data), "huge.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ensureRendition(ctx, Media{Path: info.Key, SHA256: "huge", ContentType: "image/png"}, ThumbnailSpec{64, 64, fitCover})
+	assert.ErrorIs(t, err, errImageTooLarge)
+
+	// 2048x32768 pixels are too many in color, though not in gray
+	for colorType, tooLarge := range map[byte]bool{0: false, 6: true} {
+		data[25] = colorType
+		binary.BigEndian.PutUint32(data[16:], 2048)
+		binary.BigEndian.PutUint32(data[20:], 32768)
+		binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+		info, err := saveFile(ctx, bytes.NewReader(data), "tall.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ensureRendition(ctx, Media{Path: info.Key, SHA256: fmt.Sprint("tall", colorType), ContentType: "image/png"}, ThumbnailSpec{64, 64, fitCover})
+		assert.Equal(t, tooLarge, errors.Is(err, errImageTooLarge), "color type %d: %v", colorType, err)
+	}
+}
+
+func TestDecodeSlots(t *testing.T) {
+	release, err := acquireDecodeSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	releases := []func(){release}
+	for len(releases) < cap(decodeSlots) {
+		release, _ := acquireDecodeSlot(context.Background())
+		releases = append(releases, release)
+	}
+
+	// every slot is taken, decoding waits
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = acquireDecodeSlot(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	releases[0]()
+	release, err = acquireDecodeSlot(context.Background())
+	assert.NoError(t, err)
+	release()
+	for _, release := range releases[1:] {
+		release()
+	}
+}
+
+func TestMediaThumbnail(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	previous := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previous }()
+
+	data, _ := os.ReadFile("../static/tests/bg.png")
+	info, err := saveFile(context.Background(), bytes.NewReader(data), "bg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	media := Media{Name: "media1", Path: info.Key, ContentType: "image/png"}
+	db.Create(&media)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/media/{id}/thumbnail", func(w http.ResponseWriter, r *http.Request) { MediaThumbnail(w, r, db) })
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/media/%d/thumbnail?w=50&h=50&fit=fill", media.ID), nil))
+	if status := recorder.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	assert.Equal(t, "image/png", recorder.Header().Get("Content-Type"))
+	thumb, err := png.DecodeConfig(recorder.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, thumb.Width)
+	assert.Equal(t, 50, thumb.Height)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/v1/media/%d/thumbnail", media.ID), nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/media/999999/thumbnail?w=50", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
@@ -0,0 +1,682 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bee-keeper/tags-api/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// tusVersion is the version of the tus resumable upload protocol served under /v1/uploads
+const tusVersion = "1.0.0"
+
+// tusExtensions are the tus extensions the upload routes support
+const tusExtensions = "creation,termination,expiration"
+
+// UploadExpiry is how long an unfinished upload is kept after its last chunk, main sets it from UPLOAD_EXPIRY
+var UploadExpiry = 24 * time.Hour
+
+// Upload - resumable upload in progress, its chunks are staged as parts in the storage backend until
+// the last chunk finalizes it into a Media
+type Upload struct {
+	ID        string `gorm:"primaryKey;size:32"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Length    int64 `gorm:"not null"`
+	Offset    int64 `gorm:"not null;default:0"`
+	// Metadata is the Upload-Metadata header the upload was created with
+	Metadata  string
+	ExpiresAt time.Time `gorm:"index"`
+	// MediaID is set once the upload has been finalized
+	MediaID *uint
+	Parts   []UploadPart `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// UploadPart - staged chunk of an upload, recorded once the chunk has claimed its offset
+type UploadPart struct {
+	UploadID string `gorm:"primaryKey;size:32"`
+	Offset   int64  `gorm:"primaryKey"`
+	Key      string `gorm:"not null"`
+	Size     int64  `gorm:"not null"`
+}
+
+// uploadStaging is the backend chunks are staged in, the quarantine while scanning is on so unscanned
+// content stays out of Store. Every API instance sees the same parts.
+func uploadStaging() storage.Storage {
+	if Scanner != nil {
+		return Quarantine
+	}
+	return Store
+}
+
+// partPrefix is the key prefix of the staged parts of the upload
+func (u *Upload) partPrefix() string {
+	return "uploads/" + u.ID + "/"
+}
+
+// partKey is the key of a part starting at offset, the token keeps chunks sent for the same offset apart
+func (u *Upload) partKey(offset int64, token string) string {
+	return fmt.Sprintf("%s%020d-%s", u.partPrefix(), offset, token)
+}
+
+// location is the URL of the upload
+func (u *Upload) location() string {
+	return "/v1/uploads/" + u.ID
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header, "key base64value" pairs separated by commas
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("Invalid Upload-Metadata")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Upload-Metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// uploadFields reads the media fields from the upload metadata, name, tags, filename and on_duplicate
+func uploadFields(metadata map[string]string) (mediaUpload, error) {
+	upload := mediaUpload{
+		name:        metadata["name"],
+		filename:    metadata["filename"],
+		onDuplicate: metadata["on_duplicate"],
+	}
+	if upload.name == "" {
+		upload.name = upload.filename
+	}
+	if upload.name == "" {
+		return upload, errors.New("Name is required")
+	}
+	if tags := metadata["tags"]; tags != "" {
+		if err := json.Unmarshal([]byte(tags), &upload.tags); err != nil || validateTags(upload.tags) != nil {
+			return upload, errors.New("Invalid tags format")
+		}
+	}
+	switch upload.onDuplicate {
+	case "":
+		upload.onDuplicate = "new"
+	case "new", "reuse":
+	default:
+		return upload, errors.New("OnDuplicate must be 'new' or 'reuse'")
+	}
+	return upload, nil
+}
+
+// newUploadID returns a random upload ID
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Uploads - creates resumable uploads following the tus protocol
+func Uploads(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.URL.Path != "/v1/uploads" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	switch r.Method {
+	case http.MethodPost:
+		if !tusResumable(w, r) {
+			return
+		}
+		if r.Header.Get("Upload-Defer-Length") != "" {
+			http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+			return
+		}
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+		if length > MaxUploadSize {
+			http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the fields are checked now rather than after the whole file has been sent
+		if _, err := uploadFields(metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id, err := newUploadID()
+		if err != nil {
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+		upload := Upload{
+			ID:        id,
+			Length:    length,
+			Metadata:  r.Header.Get("Upload-Metadata"),
+			ExpiresAt: time.Now().Add(UploadExpiry),
+		}
+		if err := db.Create(&upload).Error; err != nil {
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+
+		// an empty upload is complete as soon as it exists, no one else knows of it yet
+		if length == 0 {
+			if _, err := finalizeUpload(r.Context(), db, &upload); err != nil {
+				writeFinalizeError(w, &upload, err)
+				return
+			}
+			w.Header().Set("Media-Location", fmt.Sprintf("/v1/media/%d", *upload.MediaID))
+		}
+		w.Header().Set("Location", upload.location())
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodOptions:
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(MaxUploadSize, 10))
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SingleUpload - reports, continues and terminates one resumable upload following the tus protocol
+func SingleUpload(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	switch r.Method {
+	case http.MethodHead:
+		var upload Upload
+		if !loadUpload(w, db, id, &upload) {
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if upload.Metadata != "" {
+			w.Header().Set("Upload-Metadata", upload.Metadata)
+		}
+		if upload.MediaID != nil {
+			w.Header().Set("Media-Location", fmt.Sprintf("/v1/media/%d", *upload.MediaID))
+		} else {
+			w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if !tusResumable(w, r) {
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+			return
+		}
+
+		var upload Upload
+		if !loadUpload(w, db, id, &upload) {
+			return
+		}
+		if upload.MediaID != nil {
+			http.Error(w, "Upload is already complete", http.StatusForbidden)
+			return
+		}
+		if offset != upload.Offset {
+			http.Error(w, "Upload-Offset doesn't match the upload", http.StatusConflict)
+			return
+		}
+
+		// the chunk is written before its offset is claimed, no lock is held while it streams in
+		part, err := writeChunk(r.Context(), &upload, r.Body)
+		if err != nil && !errors.Is(err, errReadChunk) {
+			log.Printf("failed to stage chunk of upload %s: %v", upload.ID, err)
+			http.Error(w, "Failed to save upload", http.StatusInternalServerError)
+			return
+		}
+		readErr := err
+		// whatever arrived is kept, even when the connection broke off, so the client can resume
+		if part.Size > 0 {
+			if err := claimChunk(db, &upload, part); err != nil {
+				discardPart(r.Context(), part)
+				if errors.Is(err, errOffsetMoved) {
+					http.Error(w, "Upload-Offset doesn't match the upload", http.StatusConflict)
+					return
+				}
+				http.Error(w, "Failed to save upload", http.StatusInternalServerError)
+				return
+			}
+		}
+		if readErr != nil {
+			http.Error(w, "Failed to read upload", http.StatusBadRequest)
+			return
+		}
+
+		// a failed finalize keeps the offset, the client finishes the upload with an empty chunk
+		if upload.Offset == upload.Length {
+			if _, err := finalizeUpload(r.Context(), db, &upload); err != nil {
+				writeFinalizeError(w, &upload, err)
+				return
+			}
+		}
+		if upload.MediaID != nil {
+			w.Header().Set("Media-Location", fmt.Sprintf("/v1/media/%d", *upload.MediaID))
+		} else {
+			w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !tusResumable(w, r) {
+			return
+		}
+		var upload Upload
+		if !loadUpload(w, db, id, &upload) {
+			return
+		}
+		// a chunk still being written finds its offset gone and drops its part
+		if err := db.Delete(&upload).Error; err != nil {
+			http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+			return
+		}
+		removeStaged(r.Context(), db, &upload)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodOptions:
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Allow", "HEAD, PATCH, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "HEAD, PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// tusResumable checks the client speaks the supported protocol version, writing the error response if not
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// loadUpload fetches an upload that hasn't expired, writing the error response if it can't
+func loadUpload(w http.ResponseWriter, db *gorm.DB, id string, upload *Upload) bool {
+	if err := db.First(upload, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return false
+		}
+		http.Error(w, "Failed to fetch upload", http.StatusInternalServerError)
+		return false
+	}
+	if upload.MediaID == nil && time.Now().After(upload.ExpiresAt) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return false
+	}
+	return true
+}
+
+// errReadChunk wraps the error of a chunk whose connection broke off
+var errReadChunk = errors.New("reading chunk")
+
+// chunkReader ends a chunk early where reading it fails, so the part keeps what did arrive
+type chunkReader struct {
+	r   io.Reader
+	err error
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		c.err = err
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// writeChunk stages a chunk as a new part at the upload's offset, never past its length. The part
+// keeps what arrived even if reading the chunk failed part way, an empty part isn't kept.
+func writeChunk(ctx context.Context, upload *Upload, body io.Reader) (UploadPart, error) {
+	token, err := newUploadID()
+	if err != nil {
+		return UploadPart{}, err
+	}
+	chunk := &chunkReader{r: io.LimitReader(body, upload.Length-upload.Offset)}
+	part := UploadPart{UploadID: upload.ID, Offset: upload.Offset, Key: upload.partKey(upload.Offset, token)}
+	info, err := uploadStaging().Put(ctx, part.Key, chunk)
+	if err != nil {
+		return UploadPart{}, err
+	}
+	part.Size = info.Size
+	if part.Size == 0 {
+		if err := uploadStaging().Delete(ctx, part.Key); err != nil {
+			return UploadPart{}, err
+		}
+	}
+	if chunk.err != nil {
+		return part, fmt.Errorf("%w: %v", errReadChunk, chunk.err)
+	}
+	return part, nil
+}
+
+// errOffsetMoved means the upload's offset moved on, or the upload went, while a chunk was written
+var errOffsetMoved = errors.New("upload offset moved")
+
+// claimChunk records a written part and moves the upload's offset past it, provided the offset is
+// still the one the part was written at. Of two chunks sent for the same offset only one gets it.
+func claimChunk(db *gorm.DB, upload *Upload, part UploadPart) error {
+	expiresAt := time.Now().Add(UploadExpiry)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Upload{}).
+			Where(map[string]any{"id": upload.ID, "offset": part.Offset, "media_id": nil}).
+			Updates(map[string]any{"offset": part.Offset + part.Size, "expires_at": expiresAt})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errOffsetMoved
+		}
+		return tx.Create(&part).Error
+	})
+	if err != nil {
+		return err
+	}
+	upload.Offset, upload.ExpiresAt = part.Offset+part.Size, expiresAt
+	return nil
+}
+
+// discardPart removes a part that lost its offset, logging failures like discardFile
+func discardPart(ctx context.Context, part UploadPart) {
+	if err := uploadStaging().Delete(context.WithoutCancel(ctx), part.Key); err != nil {
+		log.Printf("failed to remove staged part %q: %v", part.Key, err)
+	}
+}
+
+// partsReader reads staged parts one after the other, opening each in turn
+type partsReader struct {
+	ctx     context.Context
+	keys    []string
+	current io.ReadCloser
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if len(p.keys) == 0 {
+				return 0, io.EOF
+			}
+			part, err := uploadStaging().Get(p.ctx, p.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			p.current, p.keys = part, p.keys[1:]
+		}
+		n, err := p.current.Read(b)
+		if err == io.EOF {
+			p.current.Close()
+			p.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.current == nil {
+		return nil
+	}
+	return p.current.Close()
+}
+
+// stagedContent reads the content of a complete upload from its recorded parts, parts of chunks that
+// lost their offset are never read
+func stagedContent(ctx context.Context, db *gorm.DB, upload *Upload) (io.ReadCloser, error) {
+	var parts []UploadPart
+	if err := db.Where("upload_id = ?", upload.ID).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: "offset"}}).Find(&parts).Error; err != nil {
+		return nil, err
+	}
+	reader := &partsReader{ctx: ctx}
+	offset := int64(0)
+	for _, part := range parts {
+		if part.Offset != offset {
+			break
+		}
+		reader.keys = append(reader.keys, part.Key)
+		offset += part.Size
+	}
+	if offset != upload.Length {
+		return nil, fmt.Errorf("upload %s has no part at offset %d", upload.ID, offset)
+	}
+	return reader, nil
+}
+
+// errUploadFields wraps metadata that no longer makes a valid Media, e.g. an empty tag name
+var errUploadFields = errors.New("invalid upload metadata")
+
+// errUploadRejected wraps the reason an upload was found infected, its Media records the rejection
+var errUploadRejected = errors.New("Media rejected")
+
+// errUploadFinalized means another request finalized the upload first
+var errUploadFinalized = errors.New("upload already finalized")
+
+// finalizeUpload moves a complete upload into storage and creates its Media, then drops the staged
+// data. No lock is held meanwhile: the Media is created in the same transaction that sets the
+// upload's media_id, so a retried or concurrent finalize ends with the Media of the first.
+func finalizeUpload(ctx context.Context, db *gorm.DB, upload *Upload) (Media, error) {
+	metadata, err := parseUploadMetadata(upload.Metadata)
+	if err != nil {
+		return Media{}, fmt.Errorf("%w: %v", errUploadFields, err)
+	}
+	fields, err := uploadFields(metadata)
+	if err != nil {
+		return Media{}, fmt.Errorf("%w: %v", errUploadFields, err)
+	}
+	fields.link = func(tx *gorm.DB, media Media) error {
+		result := tx.Model(&Upload{}).Where("id = ? AND media_id IS NULL", upload.ID).Update("media_id", media.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errUploadFinalized
+		}
+		return nil
+	}
+
+	file, err := stagedContent(ctx, db, upload)
+	if err != nil {
+		return finalizedMedia(ctx, db, upload, err)
+	}
+	defer file.Close()
+	content := newHashingReader(file, func(contentType string) error {
+		return checkContentType(contentType, fields.filename)
+	})
+	info, result, err := saveUpload(ctx, content, uploadKey(fields.name, fields.filename))
+	if err != nil {
+		// content that is refused now will be refused on every retry
+		var typeErr *contentTypeError
+		if errors.As(content.err, &typeErr) {
+			if err := db.Where("id = ? AND media_id IS NULL", upload.ID).Delete(&Upload{}).Error; err != nil {
+				log.Printf("failed to remove refused upload %s: %v", upload.ID, err)
+			}
+			removeStaged(ctx, db, upload)
+			return Media{}, typeErr
+		}
+		// the parts may have gone with a finalize that got there first
+		return finalizedMedia(ctx, db, upload, err)
+	}
+	fields.setContent(info, content, result)
+
+	media, _, err := createMedia(ctx, db, fields)
+	if errors.Is(err, errUploadFinalized) {
+		return finalizedMedia(ctx, db, upload, err)
+	}
+	if err != nil {
+		return Media{}, err
+	}
+	upload.MediaID = &media.ID
+	removeStaged(ctx, db, upload)
+	if media.ProcessingStatus == processingRejected {
+		return media, fmt.Errorf("%w: %s", errUploadRejected, media.RejectionReason)
+	}
+	return media, nil
+}
+
+// finalizedMedia returns the Media of an upload another request finalized, or err if it wasn't
+func finalizedMedia(ctx context.Context, db *gorm.DB, upload *Upload, err error) (Media, error) {
+	var current Upload
+	if db.First(&current, "id = ?", upload.ID).Error != nil || current.MediaID == nil {
+		return Media{}, err
+	}
+	var media Media
+	if err := db.First(&media, *current.MediaID).Error; err != nil {
+		return Media{}, err
+	}
+	upload.MediaID = current.MediaID
+	removeStaged(ctx, db, upload)
+	if media.ProcessingStatus == processingRejected {
+		return media, fmt.Errorf("%w: %s", errUploadRejected, media.RejectionReason)
+	}
+	return media, nil
+}
+
+// writeFinalizeError writes the response for an upload that couldn't be finalized
+func writeFinalizeError(w http.ResponseWriter, upload *Upload, err error) {
+	if errors.Is(err, errUploadRejected) {
+		w.Header().Set("Media-Location", fmt.Sprintf("/v1/media/%d", *upload.MediaID))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, errScanFailed) {
+		log.Printf("failed to scan upload %s: %v", upload.ID, err)
+		http.Error(w, "Upload could not be scanned for malware", http.StatusServiceUnavailable)
+		return
+	}
+	var typeErr *contentTypeError
+	if errors.As(err, &typeErr) {
+		http.Error(w, typeErr.Msg, typeErr.Status)
+		return
+	}
+	if errors.Is(err, errUploadFields) || errors.Is(err, errEmptyTagName) {
+		http.Error(w, "Invalid upload metadata", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Error saving media", http.StatusInternalServerError)
+}
+
+// removeStaged deletes the staged parts of an upload with their records, logging failures like discardFile
+func removeStaged(ctx context.Context, db *gorm.DB, upload *Upload) {
+	ctx = context.WithoutCancel(ctx)
+	if err := db.Where("upload_id = ?", upload.ID).Delete(&UploadPart{}).Error; err != nil {
+		log.Printf("failed to remove the parts of upload %s: %v", upload.ID, err)
+	}
+	parts, err := uploadStaging().List(ctx, upload.partPrefix())
+	if err != nil {
+		log.Printf("failed to list staged parts of upload %s: %v", upload.ID, err)
+		return
+	}
+	for _, part := range parts {
+		if err := uploadStaging().Delete(ctx, part.Key); err != nil {
+			log.Printf("failed to remove staged part %q: %v", part.Key, err)
+		}
+	}
+}
+
+// ExpireUploads deletes the uploads that expired, unfinished or finished, with their staged data
+func ExpireUploads(db *gorm.DB, now time.Time) (int, error) {
+	var expired []Upload
+	if err := db.Where("expires_at < ?", now).Find(&expired).Error; err != nil {
+		return 0, err
+	}
+	removed := 0
+	for i := range expired {
+		ok, err := expireUpload(db, &expired[i], now)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// expireUpload deletes an upload listed as expired, unless a chunk claimed an offset since and
+// renewed it. It reports whether the upload was deleted.
+func expireUpload(db *gorm.DB, upload *Upload, now time.Time) (bool, error) {
+	result := db.Where("id = ? AND expires_at < ?", upload.ID, now).Delete(&Upload{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	removeStaged(context.Background(), db, upload)
+	return true, nil
+}
+
+// StartUploadJanitor expires uploads every interval until ctx is cancelled
+func StartUploadJanitor(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if n, err := ExpireUploads(db, now); err != nil {
+					log.Printf("failed to expire uploads: %v", err)
+				} else if n > 0 {
+					log.Printf("expired %d uploads", n)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bee-keeper/tags-api/storage"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	metadata, err := parseUploadMetadata("name " + base64.StdEncoding.EncodeToString([]byte("holiday")) + ",empty,tags W10=")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"name": "holiday", "empty": "", "tags": "[]"}, metadata)
+
+	_, err = parseUploadMetadata("name !!!")
+	assert.Error(t, err)
+
+	fields, err := uploadFields(map[string]string{"filename": "clip.mp4"})
+	assert.NoError(t, err)
+	assert.Equal(t, "clip.mp4", fields.name, "Expected the file name to stand in for a missing name")
+	assert.Equal(t, "new", fields.onDuplicate)
+
+	_, err = uploadFields(map[string]string{"name": "clip", "tags": `[{"name":" "}]`})
+	assert.Error(t, err)
+}
+
+// brokenReader returns its data, then fails like a connection breaking off
+type brokenReader struct{ data []byte }
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func TestStagedParts(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	ctx := context.Background()
+	previousStore := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previousStore }()
+	upload := Upload{ID: "abc", Length: 10, ExpiresAt: time.Now().Add(UploadExpiry)}
+	db.Create(&upload)
+
+	part, err := writeChunk(ctx, &upload, strings.NewReader("01234"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), part.Size)
+	assert.NoError(t, claimChunk(db, &upload, part))
+
+	// what arrived before the connection broke off is kept
+	part, err = writeChunk(ctx, &upload, &brokenReader{data: []byte("56")})
+	assert.ErrorIs(t, err, errReadChunk)
+	assert.Equal(t, int64(2), part.Size)
+	assert.NoError(t, claimChunk(db, &upload, part))
+
+	// of two chunks written for the same offset only the first to claim it counts
+	part, err = writeChunk(ctx, &upload, strings.NewReader("789 and more"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), part.Size, "Expected a chunk to stop at the upload length")
+	late, err := writeChunk(ctx, &upload, strings.NewReader("xyz"))
+	assert.NoError(t, err)
+	assert.NoError(t, claimChunk(db, &upload, part))
+	assert.ErrorIs(t, claimChunk(db, &upload, late), errOffsetMoved)
+	assert.Equal(t, int64(10), upload.Offset)
+
+	content, err := stagedContent(ctx, db, &upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(content)
+	content.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data), "Expected the part that lost its offset to be skipped")
+
+	removeStaged(ctx, db, &upload)
+	assert.Empty(t, stored(t, Store))
+	_, err = stagedContent(ctx, db, &upload)
+	assert.Error(t, err, "Expected missing parts to be noticed")
+}
+
+func TestFinalizeUploadOnce(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+	ctx := context.Background()
+	previousStore := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previousStore }()
+	data, err := os.ReadFile("../static/tests/bg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := Upload{
+		ID:        "once",
+		Length:    int64(len(data)),
+		Metadata:  "name " + base64.StdEncoding.EncodeToString([]byte("background")),
+		ExpiresAt: time.Now().Add(UploadExpiry),
+	}
+	db.Create(&upload)
+	part, err := writeChunk(ctx, &upload, bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NoError(t, claimChunk(db, &upload, part))
+
+	// a second finalize of the same upload, like one racing the first, gets the first one's Media
+	other := upload
+	media, err := finalizeUpload(ctx, db, &upload)
+	assert.NoError(t, err)
+	again, err := finalizeUpload(ctx, db, &other)
+	assert.NoError(t, err)
+	assert.Equal(t, media.ID, again.ID)
+	assert.Equal(t, media.ID, *other.MediaID)
+
+	// a finalize that loses the race after storing the content undoes its Media and drops its copy
+	upload.ID, upload.MediaID = "lost", nil
+	db.Create(&upload)
+	part, err = writeChunk(ctx, &upload, bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NoError(t, claimChunk(db, &upload, part))
+	db.Model(&Upload{}).Where("id = ?", "lost").Update("media_id", media.ID)
+	again, err = finalizeUpload(ctx, db, &upload)
+	assert.NoError(t, err)
+	assert.Equal(t, media.ID, again.ID)
+
+	var count int64
+	db.Model(&Media{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, []string{media.Path}, stored(t, Store))
+}
+
+func newTusMux(db *gorm.DB) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/uploads", func(w http.ResponseWriter, r *http.Request) { Uploads(w, r, db) })
+	mux.HandleFunc("/v1/uploads/{id}", func(w http.ResponseWriter, r *http.Request) { SingleUpload(w, r, db) })
+	return mux
+}
+
+// tusRequest builds a request carrying the protocol version header
+func tusRequest(method, target string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	return req
+}
+
+func TestResumableUpload(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	previousStore := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previousStore }()
+
+	data, err := os.ReadFile("../static/tests/bg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newTusMux(db)
+
+	req := tusRequest("POST", "/v1/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(len(data)))
+	req.Header.Set("Upload-Metadata", "name "+base64.StdEncoding.EncodeToString([]byte("background"))+
+		",tags "+base64.StdEncoding.EncodeToString([]byte(`[{"name":"wallpaper"}]`)))
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	if status := recorder.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	location := recorder.Header().Get("Location")
+	assert.Regexp(t, `^/v1/uploads/[0-9a-f]{32}$`, location)
+
+	patch := func(offset int, chunk []byte) *httptest.ResponseRecorder {
+		req := tusRequest("PATCH", location, chunk)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	half := len(data) / 2
+	recorder = patch(0, data[:half])
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, strconv.Itoa(half), recorder.Header().Get("Upload-Offset"))
+
+	// a client resuming from a stale offset is told to ask again
+	recorder = patch(0, data[:half])
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, tusRequest("HEAD", location, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, strconv.Itoa(half), recorder.Header().Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(data)), recorder.Header().Get("Upload-Length"))
+
+	recorder = patch(half, data[half:])
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	mediaLocation := recorder.Header().Get("Media-Location")
+	assert.Regexp(t, `^/v1/media/\d+$`, mediaLocation)
+
+	var media Media
+	db.Preload("Tags").Where("name = ?", "background").First(&media)
+	assert.Equal(t, fmt.Sprintf("/v1/media/%d", media.ID), mediaLocation)
+	assert.Equal(t, "image/png", media.ContentType)
+	assert.Equal(t, int64(len(data)), media.Size)
+	if assert.Len(t, media.Tags, 1) {
+		assert.Equal(t, "wallpaper", media.Tags[0].Name)
+	}
+	info, err := Store.Stat(context.Background(), media.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.Equal(t, []string{media.Path}, stored(t, Store), "Expected the staged parts to be removed")
+
+	recorder = patch(len(data), nil)
+	assert.Equal(t, http.StatusForbidden, recorder.Code, "Expected a finished upload to take no more data")
+}
+
+func TestTerminateAndExpireUploads(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	previousStore := Store
+	Store = storage.NewLocal(t.TempDir())
+	defer func() { Store = previousStore }()
+	mux := newTusMux(db)
+
+	create := func() string {
+		req := tusRequest("POST", "/v1/uploads", nil)
+		req.Header.Set("Upload-Length", "10")
+		req.Header.Set("Upload-Metadata", "name "+base64.StdEncoding.EncodeToString([]byte("clip")))
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		return recorder.Header().Get("Location")
+	}
+
+	location := create()
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, tusRequest("DELETE", location, nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, tusRequest("HEAD", location, nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	location = create()
+	req := tusRequest("PATCH", location, []byte("01234"))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Len(t, stored(t, Store), 1)
+	expired, err := ExpireUploads(db, time.Now().Add(UploadExpiry+time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	assert.Empty(t, stored(t, Store), "Expected the staged data to be removed")
+
+	// an upload a chunk renewed after it was listed as expired is kept
+	renewed := Upload{ID: "renewed", Length: 10, ExpiresAt: time.Now().Add(UploadExpiry)}
+	db.Create(&renewed)
+	listed := renewed
+	listed.ExpiresAt = time.Now().Add(-time.Minute)
+	removed, err := expireUpload(db, &listed, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, removed)
+	assert.NoError(t, db.First(&renewed, "id = ?", "renewed").Error)
+
+	recorder = httptest.NewRecorder()
+	req = tusRequest("POST", "/v1/uploads", nil)
+	req.Header.Del("Tus-Resumable")
+	req.Header.Set("Upload-Length", "10")
+	mux.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+}
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bee-keeper/tags-api/jobs"
+	"github.com/bee-keeper/tags-api/scanner"
+	"github.com/bee-keeper/tags-api/storage"
+	"gorm.io/gorm"
+)
+
+// MaxUploadSize caps the size of a media upload request in bytes, main sets it from MAX_UPLOAD_SIZE
+var MaxUploadSize int64 = 1 << 30
+
+// maxFieldSize caps the size of the form fields next to the file
+const maxFieldSize = 1 << 20
+
+// sniffLen is how much of the content detectContentType looks at
+const sniffLen = 512
+
+// hashingReader passes content through while hashing it and keeping its head for sniffing
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	head []byte
+	// check vets the sniffed content type as soon as it is known, an error aborts the read
+	check   func(contentType string) error
+	checked bool
+	// err is the first read error other than io.EOF, storage backends don't all wrap it
+	err error
+}
+
+func newHashingReader(r io.Reader, check func(contentType string) error) *hashingReader {
+	return &hashingReader{r: r, hash: sha256.New(), check: check}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if missing := sniffLen - len(h.head); missing > 0 {
+		h.head = append(h.head, p[:min(n, missing)]...)
+	}
+	// refuse unwanted content before the rest of it is transferred
+	if h.check != nil && !h.checked && (len(h.head) >= sniffLen || err == io.EOF) {
+		h.checked = true
+		if checkErr := h.check(h.contentType()); checkErr != nil {
+			err = checkErr
+		}
+	}
+	if err != nil && err != io.EOF && h.err == nil {
+		h.err = err
+	}
+	return n, err
+}
+
+// contentType is sniffed from the head of the content
+func (h *hashingReader) contentType() string {
+	return detectContentType(h.head)
+}
+
+// sum is the hex SHA-256 of everything read so far
+func (h *hashingReader) sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// mediaUpload - the fields of a media upload, with the file already in storage
+type mediaUpload struct {
+	name        string
+	tags        []Tag
+	onDuplicate string
+	filename    string // as sent by the client
+	info        storage.Info
+	sha256      string
+	contentType string
+	// scannedAt is when the content was found clean, rejection why it was found infected, in which
+	// case info points into the quarantine
+	scannedAt *time.Time
+	rejection string
+	// link, when set, runs in the transaction that creates the Media, or with the Media reused, and
+	// its failure undoes the Media
+	link func(tx *gorm.DB, media Media) error
+}
+
+// setContent records the stored content of the upload and the verdict of its scan
+func (u *mediaUpload) setContent(info storage.Info, content *hashingReader, result scanner.Result) {
+	u.info = info
+	u.sha256 = content.sum()
+	u.contentType = content.contentType()
+	if result.Infected {
+		u.rejection = rejectionReason(result)
+	} else if Scanner != nil {
+		now := time.Now()
+		u.scannedAt = &now
+	}
+}
+
+// linkMedia runs the link of the upload, if it has one
+func (u *mediaUpload) linkMedia(tx *gorm.DB, media Media) error {
+	if u.link == nil {
+		return nil
+	}
+	return u.link(tx, media)
+}
+
+// discard removes the stored content of an upload that won't become a Media
+func (u *mediaUpload) discard(ctx context.Context) {
+	if u.rejection != "" {
+		discardQuarantined(ctx, u.info.Key)
+		return
+	}
+	discardFile(ctx, u.info.Key)
+}
+
+// receiveUpload streams a multipart media upload, sending the file part straight to storage instead
+// of buffering it. It writes the error response, and removes the stored file, if it can't.
+func receiveUpload(w http.ResponseWriter, r *http.Request) (mediaUpload, bool) {
+	var upload mediaUpload
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+		return upload, false
+	}
+
+	// fail writes the error response, the file is only kept once the upload is complete
+	fail := func(msg string, code int) (mediaUpload, bool) {
+		upload.discard(r.Context())
+		http.Error(w, msg, code)
+		return upload, false
+	}
+	var maxBytesErr *http.MaxBytesError
+	seen := map[string]bool{}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if errors.As(err, &maxBytesErr) {
+			return fail("Upload too large", http.StatusRequestEntityTooLarge)
+		}
+		if err != nil {
+			return fail("Invalid multipart form", http.StatusBadRequest)
+		}
+
+		field := part.FormName()
+		if seen[field] && field != "" {
+			part.Close()
+			return fail("Duplicate form field "+field, http.StatusBadRequest)
+		}
+		seen[field] = true
+
+		if field == "File" {
+			// fields sent ahead of the file are checked before anything is stored
+			upload.filename = part.FileName()
+			content := newHashingReader(part, func(contentType string) error {
+				return checkContentType(contentType, upload.filename)
+			})
+			info, result, err := saveUpload(r.Context(), content, uploadKey(upload.name, upload.filename))
+			part.Close()
+			var typeErr *contentTypeError
+			switch {
+			case errors.As(content.err, &typeErr):
+				return fail(typeErr.Msg, typeErr.Status)
+			case errors.As(content.err, &maxBytesErr):
+				return fail("Upload too large", http.StatusRequestEntityTooLarge)
+			case content.err != nil:
+				return fail("Failed to read upload", http.StatusBadRequest)
+			case errors.Is(err, errScanFailed):
+				log.Printf("failed to scan upload %q: %v", upload.filename, err)
+				return fail("Upload could not be scanned for malware", http.StatusServiceUnavailable)
+			case err != nil:
+				return fail("Error saving file", http.StatusInternalServerError)
+			}
+			upload.setContent(info, content, result)
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+		part.Close()
+		if errors.As(err, &maxBytesErr) {
+			return fail("Upload too large", http.StatusRequestEntityTooLarge)
+		}
+		if err != nil {
+			return fail("Invalid multipart form", http.StatusBadRequest)
+		}
+		if len(value) > maxFieldSize {
+			return fail("Form field "+field+" too large", http.StatusBadRequest)
+		}
+
+		switch field {
+		case "Name":
+			upload.name = string(value)
+			if upload.name == "" {
+				return fail("Name is required", http.StatusBadRequest)
+			}
+		case "Tags":
+			if err := json.Unmarshal(value, &upload.tags); err != nil || validateTags(upload.tags) != nil {
+				return fail("Invalid tags format", http.StatusBadRequest)
+			}
+		case "OnDuplicate":
+			// Duplicate content either creates another Media sharing the stored file, or reuses the existing Media
+			upload.onDuplicate = string(value)
+			if upload.onDuplicate != "new" && upload.onDuplicate != "reuse" {
+				return fail("OnDuplicate must be 'new' or 'reuse'", http.StatusBadRequest)
+			}
+		}
+	}
+
+	switch {
+	case upload.name == "":
+		return fail("Name is required", http.StatusBadRequest)
+	case !seen["File"]:
+		return fail("File is required", http.StatusBadRequest)
+	case !seen["Tags"]:
+		return fail("Invalid tags format", http.StatusBadRequest)
+	}
+	if upload.onDuplicate == "" {
+		upload.onDuplicate = "new"
+	}
+	return upload, true
+}
+
+// uploadKey builds a unique storage key from the media name, or the file name when the name
+// arrives after the file
+func uploadKey(name, filename string) string {
+	if name == "" {
+		name = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	// Clean the name and generate a unique filename hash based on it and the current time
+	return generateUniqueFilename(sanitizeString(name)) + "_" + sanitizeString(filename)
+}
+
+// createMedia saves the Media for an upload whose file is already in storage, together with its tags.
+// When reuse was asked for and the content is already known the existing Media is returned instead.
+// The stored file is removed whenever it ends up unused.
+func createMedia(ctx context.Context, db *gorm.DB, upload mediaUpload) (Media, bool, error) {
+	info, sum := upload.info, upload.sha256
+	if upload.rejection != "" {
+		return createRejectedMedia(ctx, db, upload)
+	}
+
+	if upload.onDuplicate == "reuse" {
+		var existing Media
+		// rejected media are no content to hand out, an upload matching only those makes a new one
+		result := db.Preload("Tags").Where("sha256 = ? AND processing_status <> ?", sum, processingRejected).
+			Order("id").Limit(1).Find(&existing)
+		if result.Error != nil {
+			discardFile(ctx, info.Key)
+			return Media{}, false, result.Error
+		}
+		if result.RowsAffected > 0 {
+			// the copy just stored isn't needed
+			discardFile(ctx, info.Key)
+			if err := upload.linkMedia(db, existing); err != nil {
+				return Media{}, false, err
+			}
+			return existing, true, nil
+		}
+	}
+
+	// Create the media record
+	newMedia := Media{
+		Name:             upload.name,
+		SHA256:           sum,
+		ContentType:      upload.contentType,
+		Size:             info.Size,
+		OriginalFilename: upload.filename,
+		ProcessingStatus: processingPending,
+		ScannedAt:        upload.scannedAt,
+	}
+
+	// the tagging rules add their tags to the ones sent
+	rules, err := enabledRules(db)
+	if err != nil {
+		discardFile(ctx, info.Key)
+		return Media{}, false, err
+	}
+	tags := append(append([]Tag{}, upload.tags...), ruleTags(rules, newMedia)...)
+
+	// Tags and media are saved together, a failure leaves neither new tags nor the media behind
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Ensure tags exist in the database and create them if necessary
+		dbTags, err := ensureTags(tx, tags)
+		if err != nil {
+			return err
+		}
+		newMedia.Tags = dbTags
+		// identical content is stored once, the blob counts the Media sharing it
+		key, err := acquireBlob(tx, sum, info.Key, info.Size)
+		if err != nil {
+			return err
+		}
+		newMedia.Path = key // Store the storage key, the URL is derived from the ID
+		if err := tx.Create(&newMedia).Error; err != nil {
+			return err
+		}
+		if err := adjustUsage(tx, tagIDs(dbTags), 1); err != nil {
+			return err
+		}
+		// metadata and renditions are made after the response, by a worker
+		if _, err := jobs.Enqueue(tx, jobProcessMedia, processMediaPayload{MediaID: newMedia.ID}); err != nil {
+			return err
+		}
+		return upload.linkMedia(tx, newMedia)
+	})
+	if err != nil {
+		// nothing refers to the file just stored
+		discardFile(ctx, info.Key)
+		return Media{}, false, err
+	}
+	if newMedia.Path != info.Key {
+		discardFile(ctx, info.Key)
+	}
+	return newMedia, false, nil
+}
+
+// createRejectedMedia records an upload found infected. Its content stays in the quarantine, it
+// gets neither tags nor a blob nor processing.
+func createRejectedMedia(ctx context.Context, db *gorm.DB, upload mediaUpload) (Media, bool, error) {
+	media := Media{
+		Name:             upload.name,
+		Path:             upload.info.Key,
+		SHA256:           upload.sha256,
+		ContentType:      upload.contentType,
+		Size:             upload.info.Size,
+		OriginalFilename: upload.filename,
+		ProcessingStatus: processingRejected,
+		RejectionReason:  upload.rejection,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&media).Error; err != nil {
+			return err
+		}
+		return upload.linkMedia(tx, media)
+	})
+	if err != nil {
+		upload.discard(ctx)
+		return Media{}, false, err
+	}
+	return media, false, nil
+}
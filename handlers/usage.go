@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// defaultPopularLimit is how many tags GET /v1/tags/popular returns without a limit
+const defaultPopularLimit = 10
+
+// adjustUsage moves the usage count of the tags by delta, inside the caller's transaction
+func adjustUsage(tx *gorm.DB, tagIDs []uint, delta int) error {
+	if len(tagIDs) == 0 || delta == 0 {
+		return nil
+	}
+	// lock the rows in ID order first, so uploads sharing tags queue up instead of deadlocking
+	if err := tx.Exec("SELECT id FROM tags WHERE id IN ? ORDER BY id FOR UPDATE", tagIDs).Error; err != nil {
+		return err
+	}
+	return tx.Exec("UPDATE tags SET usage_count = usage_count + ? WHERE id IN ?", delta, tagIDs).Error
+}
+
+// recountUsage recomputes the usage count of the tags from media_tags, all tags when none are given
+func recountUsage(tx *gorm.DB, tagIDs ...uint) error {
+	query := "UPDATE tags SET usage_count = (SELECT COUNT(*) FROM media_tags WHERE media_tags.tag_id = tags.id)"
+	if len(tagIDs) == 0 {
+		return tx.Exec(query).Error
+	}
+	return tx.Exec(query+" WHERE id IN ?", tagIDs).Error
+}
+
+// tagIDs returns the IDs of the tags
+func tagIDs(tags []*Tag) []uint {
+	ids := make([]uint, 0, len(tags))
+	for _, tag := range tags {
+		ids = append(ids, tag.ID)
+	}
+	return ids
+}
+
+// diffIDs returns the IDs only in after and the IDs only in before
+func diffIDs(before, after []uint) (added, removed []uint) {
+	inBefore, inAfter := map[uint]bool{}, map[uint]bool{}
+	for _, id := range before {
+		inBefore[id] = true
+	}
+	for _, id := range after {
+		inAfter[id] = true
+		if !inBefore[id] {
+			added = append(added, id)
+		}
+	}
+	for _, id := range before {
+		if !inAfter[id] {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
+
+// withMediaCounts copies the stored usage count into the media_count the client sees
+func withMediaCounts(tags []Tag) {
+	for i := range tags {
+		count := tags[i].UsageCount
+		tags[i].MediaCount = &count
+	}
+}
+
+// wantsCounts reports whether the client asked for media_count with ?counts=true
+func wantsCounts(r *http.Request) bool {
+	counts, _ := strconv.ParseBool(r.URL.Query().Get("counts"))
+	return counts
+}
+
+// parseSince reads the start of a popularity window, either a duration back from now such as
+// "24h" or "7d", or an RFC 3339 timestamp
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(since, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(since); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid since value %q", since)
+}
+
+// PopularTags - ranks tags by the number of media carrying them, optionally only counting media
+// created since a point in time
+func PopularTags(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.URL.Path != "/v1/tags/popular" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		limit := defaultPopularLimit
+		if limitStr := query.Get("limit"); limitStr != "" {
+			n, err := strconv.Atoi(limitStr)
+			if err != nil || n < 1 || n > maxPageSize {
+				http.Error(w, fmt.Sprintf("Invalid limit, must be between 1 and %d", maxPageSize), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		tags := []Tag{}
+		if sinceStr := query.Get("since"); sinceStr != "" {
+			since, err := parseSince(sinceStr, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// a window can't use the denormalized count, count the media created inside it
+			var counts []struct {
+				TagID uint
+				Count int64
+			}
+			if err := db.Raw(`SELECT media_tags.tag_id, COUNT(*) AS count FROM media_tags
+				JOIN media ON media.id = media_tags.media_id
+				WHERE media.created_at >= ? AND media.deleted_at IS NULL
+				GROUP BY media_tags.tag_id`, since).Scan(&counts).Error; err != nil {
+				http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+				return
+			}
+			if len(counts) > 0 {
+				ids := make([]uint, len(counts))
+				byID := map[uint]int64{}
+				for i, c := range counts {
+					ids[i] = c.TagID
+					byID[c.TagID] = c.Count
+				}
+				if err := db.Find(&tags, ids).Error; err != nil {
+					http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+					return
+				}
+				for i := range tags {
+					tags[i].UsageCount = byID[tags[i].ID]
+				}
+				sortByUsage(tags)
+				if len(tags) > limit {
+					tags = tags[:limit]
+				}
+			}
+		} else {
+			if err := db.Where("usage_count > 0").Order("usage_count DESC, name, id").Limit(limit).Find(&tags).Error; err != nil {
+				http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+				return
+			}
+		}
+		withMediaCounts(tags)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tags); err != nil {
+			http.Error(w, "Failed to encode tags", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodOptions:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sortByUsage orders tags by usage count, most used first, ties by name
+func sortByUsage(tags []Tag) {
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].UsageCount != tags[j].UsageCount {
+			return tags[i].UsageCount > tags[j].UsageCount
+		}
+		if tags[i].Name != tags[j].Name {
+			return tags[i].Name < tags[j].Name
+		}
+		return tags[i].ID < tags[j].ID
+	})
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		"24h":                  now.Add(-24 * time.Hour),
+		"7d":                   now.AddDate(0, 0, -7),
+		"2024-03-01T00:00:00Z": time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for in, expected := range cases {
+		since, err := parseSince(in, now)
+		assert.NoError(t, err, in)
+		assert.True(t, expected.Equal(since), "parsing %q: got %v want %v", in, since, expected)
+	}
+	for _, in := range []string{"yesterday", "-1d", "-2h"} {
+		_, err := parseSince(in, now)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestDiffIDs(t *testing.T) {
+	added, removed := diffIDs([]uint{1, 2, 3}, []uint{2, 3, 4})
+	assert.Equal(t, []uint{4}, added)
+	assert.Equal(t, []uint{1}, removed)
+}
+
+// usageCounts returns the stored usage count of each tag by name
+func usageCounts(t *testing.T, mux *http.ServeMux) map[string]int64 {
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags?counts=true", nil))
+	var tags []Tag
+	if err := json.Unmarshal(recorder.Body.Bytes(), &tags); err != nil {
+		t.Fatalf("could not unmarshal response body: %v", err)
+	}
+	counts := map[string]int64{}
+	for _, tag := range tags {
+		if assert.NotNil(t, tag.MediaCount, tag.Name) {
+			counts[tag.Name] = *tag.MediaCount
+		}
+	}
+	return counts
+}
+
+func TestUsageCounts(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags", func(w http.ResponseWriter, r *http.Request) { Tags(w, r, db) })
+	mux.HandleFunc("/v1/tags/popular", func(w http.ResponseWriter, r *http.Request) { PopularTags(w, r, db) })
+	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) { AllMedia(w, r, db) })
+	mux.HandleFunc("/v1/media/{id}", func(w http.ResponseWriter, r *http.Request) { SingleMedia(w, r, db) })
+
+	var created []Media
+	for _, tags := range []string{`[{"Name":"cat"},{"Name":"garden"}]`, `[{"Name":"cat"}]`} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, newUploadRequest(t, map[string]string{"Name": "media", "Tags": tags}, "../static/tests/bg.png"))
+		if status := recorder.Code; status != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+		var media Media
+		json.Unmarshal(recorder.Body.Bytes(), &media)
+		created = append(created, media)
+	}
+	assert.Equal(t, map[string]int64{"cat": 2, "garden": 1}, usageCounts(t, mux))
+
+	// counts are only included on request
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags", nil))
+	assert.NotContains(t, recorder.Body.String(), "media_count")
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("PATCH", fmt.Sprintf("/v1/media/%d", created[1].ID), bytes.NewBufferString(`{"tags":[{"name":"garden"},{"name":"dog"}]}`)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, map[string]int64{"cat": 1, "garden": 2, "dog": 1}, usageCounts(t, mux))
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("DELETE", fmt.Sprintf("/v1/media/%d", created[0].ID), nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, map[string]int64{"cat": 0, "garden": 1, "dog": 1}, usageCounts(t, mux))
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags/popular?limit=1", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var popular []Tag
+	json.Unmarshal(recorder.Body.Bytes(), &popular)
+	if assert.Len(t, popular, 1) {
+		assert.Equal(t, "dog", popular[0].Name, "Expected ties to be ranked by name")
+	}
+}
+
+func TestPopularTagsSince(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	cat := Tag{Name: "cat"}
+	dog := Tag{Name: "dog"}
+	db.Create(&cat)
+	db.Create(&dog)
+	old := Media{Name: "old", Tags: []*Tag{&cat}}
+	old.CreatedAt = time.Now().AddDate(0, -1, 0)
+	db.Create(&old)
+	db.Create(&Media{Name: "new1", Tags: []*Tag{&dog}})
+	db.Create(&Media{Name: "new2", Tags: []*Tag{&dog, &cat}})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/tags/popular", func(w http.ResponseWriter, r *http.Request) { PopularTags(w, r, db) })
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags/popular?since=7d", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var popular []Tag
+	json.Unmarshal(recorder.Body.Bytes(), &popular)
+	if assert.Len(t, popular, 2) {
+		assert.Equal(t, "dog", popular[0].Name)
+		assert.Equal(t, int64(2), *popular[0].MediaCount)
+		assert.Equal(t, int64(1), *popular[1].MediaCount)
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/tags/popular?since=someday", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
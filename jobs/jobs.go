@@ -0,0 +1,310 @@
+// Package jobs runs background work from a queue kept in Postgres
+package jobs
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Status - where a job is in its life
+type Status string
+
+const (
+	// StatusPending jobs wait for a worker, failed attempts go back to pending until they run out
+	StatusPending Status = "pending"
+	// StatusRunning jobs are held by a worker
+	StatusRunning Status = "running"
+	// StatusDone jobs succeeded
+	StatusDone Status = "done"
+	// StatusDead jobs failed every attempt, or have no handler, and are left for inspection
+	StatusDead Status = "dead"
+)
+
+// DefaultMaxAttempts is how often a job is tried unless enqueued otherwise
+const DefaultMaxAttempts = 5
+
+// Payload - JSON arguments of a job, kept as JSONB
+type Payload []byte
+
+// Value stores the payload as JSON, an empty payload as an empty object
+func (p Payload) Value() (driver.Value, error) {
+	if len(p) == 0 {
+		return "{}", nil
+	}
+	return string(p), nil
+}
+
+// Scan reads the payload back
+func (p *Payload) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*p = nil
+	case []byte:
+		*p = append(Payload{}, src...)
+	case string:
+		*p = Payload(src)
+	default:
+		return fmt.Errorf("cannot scan %T into Payload", src)
+	}
+	return nil
+}
+
+// MarshalJSON embeds the payload as is
+func (p Payload) MarshalJSON() ([]byte, error) {
+	if len(p) == 0 {
+		return []byte("{}"), nil
+	}
+	return p, nil
+}
+
+// UnmarshalJSON keeps the raw payload
+func (p *Payload) UnmarshalJSON(data []byte) error {
+	*p = append(Payload{}, data...)
+	return nil
+}
+
+// Job - unit of background work, Kind selects the handler and Payload carries its arguments
+type Job struct {
+	ID          uint       `json:"id" gorm:"primarykey"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Kind        string     `json:"kind" gorm:"not null;index"`
+	Payload     Payload    `json:"payload" gorm:"type:jsonb;not null"`
+	Status      Status     `json:"status" gorm:"not null;index:idx_jobs_status_run_at,priority:1"`
+	Attempts    int        `json:"attempts" gorm:"not null;default:0"`
+	MaxAttempts int        `json:"max_attempts" gorm:"not null"`
+	RunAt       time.Time  `json:"run_at" gorm:"not null;index:idx_jobs_status_run_at,priority:2"`
+	StartedAt   *time.Time `json:"started_at"`
+	HeartbeatAt *time.Time `json:"heartbeat_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	LastError   string     `json:"last_error"`
+}
+
+// LastAttempt reports whether a failure of the running attempt leaves the job dead
+func (j *Job) LastAttempt() bool {
+	return j.Attempts >= j.MaxAttempts
+}
+
+// Decode unmarshals the payload into v
+func (j *Job) Decode(v any) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Enqueue adds a job to run as soon as a worker is free. Pass the transaction that makes the work
+// necessary so the job exists exactly when its changes do.
+func Enqueue(db *gorm.DB, kind string, payload any) (Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{
+		Kind:        kind,
+		Payload:     data,
+		Status:      StatusPending,
+		MaxAttempts: DefaultMaxAttempts,
+		RunAt:       time.Now(),
+	}
+	return job, db.Create(&job).Error
+}
+
+var errNoHandler = errors.New("no handler for job kind")
+
+// Handler - does the work of one kind of job, returning an error has it retried
+type Handler func(ctx context.Context, db *gorm.DB, job *Job) error
+
+// Queue - pool of workers running the jobs kept in the database
+type Queue struct {
+	db       *gorm.DB
+	handlers map[string]Handler
+	// PollInterval is how long an idle worker waits before looking for jobs again
+	PollInterval time.Duration
+	// Heartbeat is how often a worker tells it still runs a job
+	Heartbeat time.Duration
+	// StaleAfter is how long a job may go without a heartbeat before it is assumed its worker died,
+	// and it is run again
+	StaleAfter time.Duration
+	// Backoff is the wait before the next attempt after the given number of failed ones
+	Backoff func(attempts int) time.Duration
+}
+
+// NewQueue returns a Queue working on the jobs in db
+func NewQueue(db *gorm.DB) *Queue {
+	return &Queue{
+		db:           db,
+		handlers:     map[string]Handler{},
+		PollInterval: time.Second,
+		Heartbeat:    time.Minute,
+		StaleAfter:   5 * time.Minute,
+		Backoff:      ExponentialBackoff(5*time.Second, time.Hour),
+	}
+}
+
+// Handle registers the handler for a kind of job, before the workers start
+func (q *Queue) Handle(kind string, h Handler) {
+	q.handlers[kind] = h
+}
+
+// ExponentialBackoff doubles the wait from base with every failed attempt, up to limit
+func ExponentialBackoff(base, limit time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		wait := base
+		for i := 1; i < attempts && wait < limit; i++ {
+			wait *= 2
+		}
+		return min(wait, limit)
+	}
+}
+
+// Start runs the given number of workers until ctx is done, the returned function waits for them
+// to finish the jobs they hold
+func (q *Queue) Start(ctx context.Context, workers int) (wait func()) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	return wg.Wait
+}
+
+// work runs jobs one after the other, sleeping while there are none
+func (q *Queue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		ran, err := q.RunNext(ctx)
+		if err != nil {
+			log.Printf("job queue: %v", err)
+		}
+		if ran && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
+
+// RunNext claims the next due job and runs it, it reports false when no job was due
+func (q *Queue) RunNext(ctx context.Context) (bool, error) {
+	if err := q.requeueStale(); err != nil {
+		return false, err
+	}
+	job, err := q.claim()
+	if err != nil || job == nil {
+		return false, err
+	}
+	runErr := q.run(ctx, job)
+	if runErr != nil && ctx.Err() != nil {
+		// cut short by a shutdown, which is no fault of the job
+		return true, q.release(job)
+	}
+	return true, q.finish(job, runErr)
+}
+
+// requeueStale puts jobs whose worker went away without finishing them back in the queue, or
+// buries them once that was their last attempt, so a job crashing its worker every time dies too
+func (q *Queue) requeueStale() error {
+	now := time.Now()
+	return q.db.Exec(`UPDATE jobs SET status = CASE WHEN attempts >= max_attempts THEN ? ELSE ? END,
+		finished_at = CASE WHEN attempts >= max_attempts THEN ?::timestamptz END,
+		last_error = ?, updated_at = ?
+		WHERE status = ? AND COALESCE(heartbeat_at, started_at) < ?`,
+		StatusDead, StatusPending, now, "worker went away", now, StatusRunning, now.Add(-q.StaleAfter)).Error
+}
+
+// claim marks the next due job as running. SKIP LOCKED lets workers claim jobs side by side
+// without waiting on each other's rows.
+func (q *Queue) claim() (*Job, error) {
+	var jobs []Job
+	now := time.Now()
+	err := q.db.Raw(`UPDATE jobs SET status = ?, attempts = attempts + 1, started_at = ?, heartbeat_at = ?, updated_at = ?
+		WHERE id = (SELECT id FROM jobs WHERE status = ? AND run_at <= ? ORDER BY run_at, id LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING *`, StatusRunning, now, now, now, StatusPending, now).Scan(&jobs).Error
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return &jobs[0], nil
+}
+
+// run calls the handler of a job, turning panics into errors. A heartbeat keeps the job from
+// going stale however long the handler takes.
+func (q *Queue) run(ctx context.Context, job *Job) (err error) {
+	handler, ok := q.handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("%w %q", errNoHandler, job.Kind)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go q.heartbeat(ctx, cancel, job)
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return handler(ctx, q.db, job)
+}
+
+// heartbeat refreshes the heartbeat of a running job until ctx is done. Should the job have been
+// requeued as stale meanwhile, it calls cancel so the handler stops working on it.
+func (q *Queue) heartbeat(ctx context.Context, cancel context.CancelFunc, job *Job) {
+	if q.Heartbeat <= 0 {
+		return
+	}
+	ticker := time.NewTicker(q.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			result := q.db.Model(&Job{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, StatusRunning, job.Attempts).
+				Update("heartbeat_at", now)
+			if result.Error != nil {
+				log.Printf("job queue: heartbeat of %s job %d: %v", job.Kind, job.ID, result.Error)
+			} else if result.RowsAffected == 0 {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// release hands a job interrupted by a shutdown back to the queue without counting the attempt
+func (q *Queue) release(job *Job) error {
+	return q.db.Model(&Job{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, StatusRunning, job.Attempts).
+		Updates(map[string]any{"status": StatusPending, "attempts": job.Attempts - 1, "run_at": time.Now(), "updated_at": time.Now()}).Error
+}
+
+// finish records the outcome of an attempt, scheduling a retry or burying the job when it failed
+func (q *Queue) finish(job *Job, runErr error) error {
+	now := time.Now()
+	updates := map[string]any{"finished_at": now, "updated_at": now}
+	switch {
+	case runErr == nil:
+		updates["status"], updates["last_error"] = StatusDone, ""
+	// retrying won't make a handler appear
+	case job.LastAttempt() || errors.Is(runErr, errNoHandler):
+		updates["status"], updates["last_error"] = StatusDead, runErr.Error()
+	default:
+		updates["status"], updates["last_error"] = StatusPending, runErr.Error()
+		updates["run_at"] = now.Add(q.Backoff(job.Attempts))
+	}
+	// a job requeued as stale and claimed again belongs to the newer attempt
+	if err := q.db.Model(&Job{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, StatusRunning, job.Attempts).Updates(updates).Error; err != nil {
+		return err
+	}
+	if runErr != nil {
+		return fmt.Errorf("%s job %d attempt %d: %w", job.Kind, job.ID, job.Attempts, runErr)
+	}
+	return nil
+}
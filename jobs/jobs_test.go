@@ -0,0 +1,284 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bee-keeper/tags-api/utils"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func setup() *gorm.DB {
+	db, err := gorm.Open(postgres.Open(utils.GetDSN()), &gorm.Config{})
+	if err != nil {
+		panic("Test DB connection failed")
+	}
+	if err := db.AutoMigrate(&Job{}); err != nil {
+		panic("Test DB migration failed: " + err.Error())
+	}
+	return db
+}
+
+func teardown(db *gorm.DB) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		panic("Failed to get raw DB connection")
+	}
+	if err := db.Exec("DELETE FROM jobs").Error; err != nil {
+		panic("Failed to delete records from jobs table: " + err.Error())
+	}
+	sqlDB.Close()
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, 10*time.Second)
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 60: 10 * time.Second} {
+		assert.Equal(t, want, backoff(attempts), "attempts %d", attempts)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	job := Job{Payload: Payload(`{"media_id":7}`)}
+	data, err := json.Marshal(job)
+	assert.NoError(t, err)
+	var decoded Job
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	var payload struct {
+		MediaID uint `json:"media_id"`
+	}
+	assert.NoError(t, decoded.Decode(&payload))
+	assert.Equal(t, uint(7), payload.MediaID)
+
+	value, err := Payload(nil).Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", value)
+	var scanned Payload
+	assert.NoError(t, scanned.Scan([]byte(`{"a":1}`)))
+	assert.Equal(t, Payload(`{"a":1}`), scanned)
+	assert.Error(t, scanned.Scan(42))
+}
+
+func TestRunNext(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	queue := NewQueue(db)
+	queue.Backoff = func(int) time.Duration { return 0 }
+	calls := 0
+	queue.Handle("flaky", func(_ context.Context, _ *gorm.DB, job *Job) error {
+		calls++
+		if job.Attempts < 2 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+
+	job, err := Enqueue(db, "flaky", map[string]int{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran, err := queue.RunNext(context.Background())
+	assert.True(t, ran)
+	assert.Error(t, err)
+	db.First(&job, job.ID)
+	assert.Equal(t, StatusPending, job.Status)
+	assert.Equal(t, "not yet", job.LastError)
+
+	ran, err = queue.RunNext(context.Background())
+	assert.True(t, ran)
+	assert.NoError(t, err)
+	db.First(&job, job.ID)
+	assert.Equal(t, StatusDone, job.Status)
+	assert.Equal(t, 2, job.Attempts)
+	assert.Equal(t, 2, calls)
+
+	// nothing is left to run
+	ran, err = queue.RunNext(context.Background())
+	assert.False(t, ran)
+	assert.NoError(t, err)
+}
+
+func TestDeadJobs(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	queue := NewQueue(db)
+	queue.Backoff = func(int) time.Duration { return 0 }
+	queue.Handle("broken", func(context.Context, *gorm.DB, *Job) error { panic("boom") })
+
+	broken, _ := Enqueue(db, "broken", nil)
+	db.Model(&broken).Update("max_attempts", 2)
+	unknown, _ := Enqueue(db, "unknown", nil)
+
+	for i := 0; i < 3; i++ {
+		ran, err := queue.RunNext(context.Background())
+		assert.True(t, ran)
+		assert.Error(t, err)
+	}
+	db.First(&broken, broken.ID)
+	assert.Equal(t, StatusDead, broken.Status)
+	assert.Equal(t, 2, broken.Attempts)
+	assert.Contains(t, broken.LastError, "boom")
+	// a kind without handler isn't retried
+	db.First(&unknown, unknown.ID)
+	assert.Equal(t, StatusDead, unknown.Status)
+	assert.Equal(t, 1, unknown.Attempts)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	queue := NewQueue(db)
+	queue.Handle("failing", func(context.Context, *gorm.DB, *Job) error { return errors.New("down") })
+	job, _ := Enqueue(db, "failing", nil)
+
+	queue.RunNext(context.Background())
+	db.First(&job, job.ID)
+	assert.True(t, job.RunAt.After(time.Now()), "Expected the retry to wait")
+	// the job isn't due yet
+	ran, err := queue.RunNext(context.Background())
+	assert.False(t, ran)
+	assert.NoError(t, err)
+}
+
+func TestStaleJobs(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	queue := NewQueue(db)
+	queue.Handle("work", func(context.Context, *gorm.DB, *Job) error { return nil })
+	job, _ := Enqueue(db, "work", nil)
+	// a worker claimed it long ago and went away
+	db.Model(&job).Updates(map[string]any{"status": StatusRunning, "attempts": 1, "started_at": time.Now().Add(-time.Hour)})
+	queue.StaleAfter = time.Minute
+
+	ran, err := queue.RunNext(context.Background())
+	assert.True(t, ran)
+	assert.NoError(t, err)
+	db.First(&job, job.ID)
+	assert.Equal(t, StatusDone, job.Status)
+	assert.Equal(t, 2, job.Attempts)
+
+	// a job whose worker went away on its last attempt isn't run again
+	crashing, _ := Enqueue(db, "work", nil)
+	db.Model(&crashing).Updates(map[string]any{"status": StatusRunning, "attempts": crashing.MaxAttempts, "started_at": time.Now().Add(-time.Hour)})
+	ran, err = queue.RunNext(context.Background())
+	assert.False(t, ran)
+	assert.NoError(t, err)
+	db.First(&crashing, crashing.ID)
+	assert.Equal(t, StatusDead, crashing.Status)
+	assert.Equal(t, "worker went away", crashing.LastError)
+	assert.NotNil(t, crashing.FinishedAt)
+}
+
+func TestHeartbeat(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	queue := NewQueue(db)
+	queue.Heartbeat = 10 * time.Millisecond
+	queue.StaleAfter = 50 * time.Millisecond
+	running, release := make(chan *Job), make(chan struct{})
+	queue.Handle("long", func(ctx context.Context, _ *gorm.DB, job *Job) error {
+		running <- job
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	job, _ := Enqueue(db, "long", nil)
+	done := make(chan error)
+	go func() {
+		_, err := queue.RunNext(context.Background())
+		done <- err
+	}()
+	<-running
+
+	// the job runs longer than StaleAfter without going stale
+	time.Sleep(150 * time.Millisecond)
+	assert.NoError(t, queue.requeueStale())
+	db.First(&job, job.ID)
+	assert.Equal(t, StatusRunning, job.Status)
+	close(release)
+	assert.NoError(t, <-done)
+	db.First(&job, job.ID)
+	assert.Equal(t, StatusDone, job.Status)
+
+	// a job taken from its worker stops
+	job, _ = Enqueue(db, "long", nil)
+	go func() {
+		_, err := queue.RunNext(context.Background())
+		done <- err
+	}()
+	<-running
+	db.Model(&job).Update("status", StatusPending)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the handler to be cancelled")
+	}
+}
+
+func TestShutdownReleasesJobs(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := NewQueue(db)
+	queue.Handle("slow", func(ctx context.Context, _ *gorm.DB, _ *Job) error {
+		cancel()
+		return ctx.Err()
+	})
+	job, _ := Enqueue(db, "slow", nil)
+
+	ran, err := queue.RunNext(ctx)
+	assert.True(t, ran)
+	assert.NoError(t, err)
+	db.First(&job, job.ID)
+	assert.Equal(t, StatusPending, job.Status)
+	assert.Equal(t, 0, job.Attempts, "Expected the interrupted attempt not to count")
+}
+
+func TestConcurrentWorkers(t *testing.T) {
+	db := setup()
+	defer teardown(db)
+
+	var mu sync.Mutex
+	seen := map[uint]int{}
+	queue := NewQueue(db)
+	queue.PollInterval = 10 * time.Millisecond
+	queue.Handle("count", func(_ context.Context, _ *gorm.DB, job *Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[job.ID]++
+		return nil
+	})
+	for i := 0; i < 20; i++ {
+		Enqueue(db, "count", nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := queue.Start(ctx, 4)
+	assert.Eventually(t, func() bool {
+		var pending int64
+		db.Model(&Job{}).Where("status <> ?", StatusDone).Count(&pending)
+		return pending == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	wait()
+
+	// SKIP LOCKED hands every job to exactly one worker
+	assert.Len(t, seen, 20)
+	for id, n := range seen {
+		assert.Equal(t, 1, n, "job %d", id)
+	}
+}
@@ -1,30 +1,188 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bee-keeper/tags-api/handlers"
+	"github.com/bee-keeper/tags-api/jobs"
+	"github.com/bee-keeper/tags-api/scanner"
+	"github.com/bee-keeper/tags-api/storage"
 	"github.com/bee-keeper/tags-api/utils"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 func main() {
+	// SIGTERM and Ctrl-C stop the workers and the server, letting them finish what they hold
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	db, err := gorm.Open(postgres.Open(utils.GetDSN()), &gorm.Config{})
+	if err != nil {
+		panic("DB connection failed")
+	}
 
-	db.AutoMigrate(&handlers.Tag{}, &handlers.Media{})
+	if err := handlers.Migrate(db); err != nil {
+		log.Fatalf("DB migration failed: %v", err)
+	}
 
+	store, err := newStorage()
 	if err != nil {
-		panic("DB connection failed")
+		log.Fatalf("Storage setup failed: %v", err)
+	}
+	handlers.Store = store
+	handlers.SlugifyTags = os.Getenv("TAG_SLUGS") == "true"
+	if size := os.Getenv("MAX_UPLOAD_SIZE"); size != "" {
+		maxSize, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || maxSize <= 0 {
+			log.Fatalf("Invalid MAX_UPLOAD_SIZE %q, expected a number of bytes", size)
+		}
+		handlers.MaxUploadSize = maxSize
+	}
+	if types := os.Getenv("ALLOWED_CONTENT_TYPES"); types != "" {
+		handlers.AllowedContentTypes = strings.Split(types, ",")
+	}
+	sizes, err := handlers.ParseThumbnailSizes(os.Getenv("THUMBNAIL_SIZES"))
+	if err != nil {
+		log.Fatalf("Invalid THUMBNAIL_SIZES: %v", err)
+	}
+	handlers.ThumbnailSizes = sizes
+	if n := os.Getenv("THUMBNAIL_DECODES"); n != "" {
+		decodes, err := strconv.Atoi(n)
+		if err != nil || decodes < 1 {
+			log.Fatalf("Invalid THUMBNAIL_DECODES %q, expected a positive number", n)
+		}
+		handlers.ThumbnailDecodes = decodes
+	}
+	if addr := os.Getenv("CLAMD_ADDR"); addr != "" {
+		clamd := scanner.NewClamd(addr)
+		clamd.Timeout = durationEnv("CLAMD_TIMEOUT", clamd.Timeout)
+		handlers.Scanner = clamd
+		quarantine, err := newQuarantine()
+		if err != nil {
+			log.Fatalf("Quarantine setup failed: %v", err)
+		}
+		handlers.Quarantine = quarantine
+	}
+	handlers.UploadExpiry = durationEnv("UPLOAD_EXPIRY", handlers.UploadExpiry)
+	handlers.StartUploadJanitor(ctx, db, durationEnv("UPLOAD_CLEANUP_INTERVAL", time.Hour))
+
+	workers := 4
+	if n := os.Getenv("JOB_WORKERS"); n != "" {
+		workers, err = strconv.Atoi(n)
+		if err != nil || workers < 1 {
+			log.Fatalf("Invalid JOB_WORKERS %q, expected a positive number", n)
+		}
 	}
+	queue := jobs.NewQueue(db)
+	handlers.RegisterJobs(queue)
+	waitForWorkers := queue.Start(ctx, workers)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1", func(w http.ResponseWriter, r *http.Request) { handlers.Index(w, r, db) })
 	mux.HandleFunc("/v1/tags", func(w http.ResponseWriter, r *http.Request) { handlers.Tags(w, r, db) })
+	mux.HandleFunc("/v1/tags/{id}", func(w http.ResponseWriter, r *http.Request) { handlers.SingleTag(w, r, db) })
+	mux.HandleFunc("/v1/tags/suggest", func(w http.ResponseWriter, r *http.Request) { handlers.SuggestTags(w, r, db) })
+	mux.HandleFunc("/v1/tags/popular", func(w http.ResponseWriter, r *http.Request) { handlers.PopularTags(w, r, db) })
+	mux.HandleFunc("/v1/tags/tree", func(w http.ResponseWriter, r *http.Request) { handlers.TagTree(w, r, db) })
+	mux.HandleFunc("/v1/tags/{id}/ancestors", func(w http.ResponseWriter, r *http.Request) { handlers.TagAncestors(w, r, db) })
+	mux.HandleFunc("/v1/tags/{id}/descendants", func(w http.ResponseWriter, r *http.Request) { handlers.TagDescendants(w, r, db) })
+	mux.HandleFunc("/v1/tags/{id}/related", func(w http.ResponseWriter, r *http.Request) { handlers.RelatedTags(w, r, db) })
+	mux.HandleFunc("/v1/tags/{id}/merge", func(w http.ResponseWriter, r *http.Request) { handlers.MergeTags(w, r, db) })
+	mux.HandleFunc("/v1/namespaces", func(w http.ResponseWriter, r *http.Request) { handlers.Namespaces(w, r, db) })
+	mux.HandleFunc("/v1/aliases", func(w http.ResponseWriter, r *http.Request) { handlers.Aliases(w, r, db) })
+	mux.HandleFunc("/v1/aliases/{id}", func(w http.ResponseWriter, r *http.Request) { handlers.SingleAlias(w, r, db) })
+	mux.HandleFunc("/v1/rules", func(w http.ResponseWriter, r *http.Request) { handlers.Rules(w, r, db) })
+	mux.HandleFunc("/v1/rules/{id}", func(w http.ResponseWriter, r *http.Request) { handlers.SingleRule(w, r, db) })
+	mux.HandleFunc("/v1/rules/backfill", func(w http.ResponseWriter, r *http.Request) { handlers.RulesBackfill(w, r, db) })
+	mux.HandleFunc("/v1/jobs", func(w http.ResponseWriter, r *http.Request) { handlers.Jobs(w, r, db) })
+	mux.HandleFunc("/v1/jobs/{id}", func(w http.ResponseWriter, r *http.Request) { handlers.SingleJob(w, r, db) })
+	mux.HandleFunc("/v1/uploads", func(w http.ResponseWriter, r *http.Request) { handlers.Uploads(w, r, db) })
+	mux.HandleFunc("/v1/uploads/{id}", func(w http.ResponseWriter, r *http.Request) { handlers.SingleUpload(w, r, db) })
 	mux.HandleFunc("/v1/media", func(w http.ResponseWriter, r *http.Request) { handlers.AllMedia(w, r, db) })
+	mux.HandleFunc("/v1/media/{id}", func(w http.ResponseWriter, r *http.Request) { handlers.SingleMedia(w, r, db) })
+	mux.HandleFunc("/v1/media/{id}/content", func(w http.ResponseWriter, r *http.Request) { handlers.MediaContent(w, r, db) })
+	mux.HandleFunc("/v1/media/{id}/thumbnail", func(w http.ResponseWriter, r *http.Request) { handlers.MediaThumbnail(w, r, db) })
+	mux.HandleFunc("/v1/media/{id}/suggested-tags", func(w http.ResponseWriter, r *http.Request) { handlers.SuggestedMediaTags(w, r, db) })
 
-	apiErr := http.ListenAndServe(":8080", mux)
-	log.Fatal(apiErr)
+	shutdownTimeout := durationEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 
+	<-ctx.Done()
+	log.Print("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	waitForWorkers()
+}
+
+// durationEnv reads a duration such as "30m" from an env var, exiting on values that don't parse
+func durationEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s %q, expected a duration like 30m", key, value)
+	}
+	return d
+}
+
+// newStorage returns the storage backend selected by env vars
+func newStorage() (storage.Storage, error) {
+	switch backend := utils.GetEnv("STORAGE_BACKEND", "local"); backend {
+	case "local":
+		return storage.NewLocal(utils.GetEnv("STORAGE_ROOT", handlers.DefaultStorageRoot)), nil
+	case "s3":
+		return storage.NewS3(s3Config(os.Getenv("S3_BUCKET")))
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// newQuarantine returns the backend uploads are held in until scanned, of the same kind as the
+// storage backend but apart from it
+func newQuarantine() (storage.Storage, error) {
+	switch backend := utils.GetEnv("STORAGE_BACKEND", "local"); backend {
+	case "local":
+		return storage.NewLocal(utils.GetEnv("QUARANTINE_ROOT", handlers.DefaultQuarantineRoot)), nil
+	case "s3":
+		bucket := os.Getenv("S3_QUARANTINE_BUCKET")
+		if bucket == "" || bucket == os.Getenv("S3_BUCKET") {
+			return nil, fmt.Errorf("S3_QUARANTINE_BUCKET must name a bucket other than S3_BUCKET")
+		}
+		return storage.NewS3(s3Config(bucket))
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// s3Config reads the S3 connection settings from env vars
+func s3Config(bucket string) storage.S3Config {
+	return storage.S3Config{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          bucket,
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PathStyle:       os.Getenv("S3_PATH_STYLE") == "true",
+	}
 }
@@ -0,0 +1,128 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultChunkSize is how much content goes into one INSTREAM chunk, clamd's StreamMaxLength still
+// caps the whole stream
+const defaultChunkSize = 64 << 10
+
+var errReadContent = errors.New("clamd: reading content")
+
+// Clamd - Scanner speaking the clamd protocol over TCP
+type Clamd struct {
+	// Addr is the host:port clamd listens on, 3310 by default
+	Addr string
+	// Timeout bounds a whole scan, including sending the content
+	Timeout time.Duration
+	// ChunkSize is the size of the INSTREAM chunks
+	ChunkSize int
+}
+
+// NewClamd returns a Scanner using the clamd daemon at addr
+func NewClamd(addr string) *Clamd {
+	return &Clamd{Addr: addr, Timeout: time.Minute, ChunkSize: defaultChunkSize}
+}
+
+// Scan streams r to clamd with the INSTREAM command
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return Result{}, fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// cancellation interrupts blocked reads and writes
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	sendErr := c.send(conn, r)
+	if errors.Is(sendErr, errReadContent) {
+		// clamd still waits for the end of the stream, there is no reply to read
+		return Result{}, sendErr
+	}
+	// clamd replies and closes the connection early on streams it refuses, so the reply is read
+	// even when sending failed
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if sendErr != nil {
+			return Result{}, fmt.Errorf("clamd: %w", sendErr)
+		}
+		if ctx.Err() != nil {
+			return Result{}, fmt.Errorf("clamd: %w", ctx.Err())
+		}
+		return Result{}, fmt.Errorf("clamd: reading reply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+// send writes the INSTREAM command, the content in length prefixed chunks and the zero length end
+func (c *Clamd) send(conn net.Conn, r io.Reader) error {
+	w := bufio.NewWriter(conn)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return err
+	}
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	buf := make([]byte, chunkSize)
+	var size [4]byte
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := w.Write(size[:]); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errReadContent, err)
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// parseReply reads a reply such as "stream: OK", "stream: Eicar-Signature FOUND" or
+// "INSTREAM size limit exceeded. ERROR"
+func parseReply(reply string) (Result, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	status := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	case strings.HasSuffix(status, " ERROR"):
+		return Result{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(status, " ERROR"))
+	default:
+		return Result{}, fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+}
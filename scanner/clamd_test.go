@@ -0,0 +1,145 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eicar is the standard antivirus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd serves the INSTREAM command like clamd, finding the EICAR string and refusing streams
+// longer than maxLength. It returns the address it listens on.
+func fakeClamd(t *testing.T, maxLength int) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn, maxLength)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveClamd(conn net.Conn, maxLength int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	if command != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+	var content bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if content.Len()+int(size) > maxLength {
+			io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+			return
+		}
+		if _, err := io.CopyN(&content, r, int64(size)); err != nil {
+			return
+		}
+	}
+	if bytes.Contains(content.Bytes(), []byte(eicar)) {
+		io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+		return
+	}
+	io.WriteString(conn, "stream: OK\x00")
+}
+
+func TestClamdScan(t *testing.T) {
+	clamd := NewClamd(fakeClamd(t, 1<<20))
+	clamd.ChunkSize = 16 // the content spans several chunks
+
+	result, err := clamd.Scan(context.Background(), strings.NewReader("just a holiday picture"))
+	assert.NoError(t, err)
+	assert.False(t, result.Infected)
+
+	result, err = clamd.Scan(context.Background(), strings.NewReader("header "+eicar+" trailer"))
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Infected: true, Signature: "Eicar-Signature"}, result)
+
+	result, err = clamd.Scan(context.Background(), strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.False(t, result.Infected)
+}
+
+func TestClamdErrors(t *testing.T) {
+	// streams over clamd's limit are refused, which is no verdict
+	clamd := NewClamd(fakeClamd(t, 1024))
+	_, err := clamd.Scan(context.Background(), bytes.NewReader(make([]byte, 1<<20)))
+	assert.ErrorContains(t, err, "size limit exceeded")
+
+	_, err = clamd.Scan(context.Background(), io.MultiReader(strings.NewReader("abc"), errReader{}))
+	assert.ErrorIs(t, err, errReadContent)
+
+	// nothing listens on a closed listener's port
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	listener.Close()
+	_, err = NewClamd(listener.Addr().String()).Scan(context.Background(), strings.NewReader("abc"))
+	assert.Error(t, err)
+}
+
+func TestClamdTimeout(t *testing.T) {
+	// a daemon that never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	clamd := NewClamd(listener.Addr().String())
+	clamd.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err = clamd.Scan(context.Background(), strings.NewReader("abc"))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestParseReply(t *testing.T) {
+	result, err := parseReply("stream: Win.Test.EICAR_HDB-1 FOUND\x00")
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, result)
+
+	_, err = parseReply("stream: lstat() failed. ERROR")
+	assert.ErrorContains(t, err, "lstat() failed")
+	_, err = parseReply("PONG")
+	assert.Error(t, err)
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("disk went away") }
@@ -0,0 +1,20 @@
+// Package scanner checks uploaded content for malware
+package scanner
+
+import (
+	"context"
+	"io"
+)
+
+// Result - verdict on scanned content
+type Result struct {
+	Infected bool
+	// Signature names what was found in infected content
+	Signature string
+}
+
+// Scanner - malware scanner content is streamed to
+type Scanner interface {
+	// Scan reads r to the end and reports whether it is infected. An error means no verdict was reached.
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
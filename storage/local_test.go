@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalPutGetStatDelete(t *testing.T) {
+	root := t.TempDir()
+	s := NewLocal(root)
+	ctx := context.Background()
+
+	info, err := s.Put(ctx, "nested/file.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	assert.Equal(t, "nested/file.txt", info.Key)
+	assert.Equal(t, int64(5), info.Size)
+
+	onDisk, err := os.ReadFile(filepath.Join(root, "nested", "file.txt"))
+	if err != nil {
+		t.Fatalf("file not written below the root: %v", err)
+	}
+	assert.Equal(t, "hello", string(onDisk))
+	stat, err := os.Stat(filepath.Join(root, "nested", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(fileMode), stat.Mode().Perm(), "Expected stored files to be readable by others")
+
+	obj, err := s.Get(ctx, "nested/file.txt")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	data, _ := io.ReadAll(obj)
+	obj.Close()
+	assert.Equal(t, "hello", string(data))
+
+	if err := s.Delete(ctx, "nested/file.txt"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	_, err = s.Stat(ctx, "nested/file.txt")
+	assert.ErrorIs(t, err, ErrNotExist)
+	_, err = s.Get(ctx, "nested/file.txt")
+	assert.ErrorIs(t, err, ErrNotExist)
+	assert.NoError(t, s.Delete(ctx, "nested/file.txt"), "Deleting a missing key should not fail")
+}
+
+func TestLocalRejectsEscapingKeys(t *testing.T) {
+	s := NewLocal(t.TempDir())
+
+	for _, key := range []string{"", "../outside", "/etc/passwd", "a/../../b"} {
+		_, err := s.Put(context.Background(), key, strings.NewReader("x"))
+		assert.ErrorIs(t, err, ErrInvalidKey, "key %q should be rejected", key)
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	s := NewLocal(t.TempDir())
+	ctx := context.Background()
+
+	for _, key := range []string{"x/1", "x/2", "y/1"} {
+		if _, err := s.Put(ctx, key, strings.NewReader(key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	infos, err := s.List(ctx, "x/")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	keys := []string{}
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	assert.Equal(t, []string{"x/1", "x/2"}, keys)
+
+	empty, err := NewLocal(filepath.Join(t.TempDir(), "missing")).List(ctx, "")
+	assert.NoError(t, err)
+	assert.Empty(t, empty)
+}
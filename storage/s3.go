@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minPartSize is the smallest part S3 accepts in a multipart upload, except for the last one
+const minPartSize = 5 << 20
+
+// unsignedPayload lets requests stream bodies without hashing them up front
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Config - connection settings for an S3 compatible service
+type S3Config struct {
+	Endpoint        string // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket in the path rather than the host name, as MinIO expects
+	PathStyle bool
+	// PartSize is the multipart upload chunk size, raised to the S3 minimum of 5MB
+	PartSize int64
+	Client   *http.Client
+}
+
+// S3 - Storage backed by an S3 compatible object store
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3 returns a Storage keeping files in the configured bucket
+func NewS3(cfg S3Config) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("storage: invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("storage: S3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize < minPartSize {
+		cfg.PartSize = minPartSize
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{cfg: cfg, endpoint: endpoint, client: client, now: time.Now}, nil
+}
+
+// Put uploads small objects in one request and larger ones as a multipart upload,
+// so the size doesn't need to be known in advance
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) (Info, error) {
+	if key == "" {
+		return Info{}, ErrInvalidKey
+	}
+
+	buf := make([]byte, s.cfg.PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if _, err := s.do(ctx, http.MethodPut, key, nil, nil, buf[:n], http.StatusOK); err != nil {
+			return Info{}, err
+		}
+		return s.Stat(ctx, key)
+	}
+	if err != nil {
+		return Info{}, err
+	}
+
+	uploadID, err := s.createMultipartUpload(ctx, key)
+	if err != nil {
+		return Info{}, err
+	}
+	if err := s.uploadParts(ctx, key, uploadID, buf, r); err != nil {
+		// don't leave the already uploaded parts behind to be billed
+		query := url.Values{"uploadId": {uploadID}}
+		s.do(context.WithoutCancel(ctx), http.MethodDelete, key, query, nil, nil, http.StatusNoContent)
+		return Info{}, err
+	}
+	return s.Stat(ctx, key)
+}
+
+// uploadParts sends the already read first part and the rest of r, then completes the upload
+func (s *S3) uploadParts(ctx context.Context, key, uploadID string, first []byte, r io.Reader) error {
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+
+	part := first
+	next := make([]byte, s.cfg.PartSize)
+	for number := 1; ; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do(ctx, http.MethodPut, key, query, nil, part, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		n, err := io.ReadFull(r, next)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		part, next = next[:n], part[:cap(part)]
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"uploadId": {uploadID}}
+	resp, err := s.do(ctx, http.MethodPost, key, query, nil, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	// S3 can report a failed completion inside a 200 response
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.Unmarshal(resp.Body, &result); err == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("storage: complete multipart upload: %s: %s", result.Code, result.Message)
+	}
+	return nil
+}
+
+// createMultipartUpload starts a multipart upload and returns its ID
+func (s *S3) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp.Body, &result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", errors.New("storage: S3 returned no upload ID")
+	}
+	return result.UploadID, nil
+}
+
+// Get returns a reader which fetches the object lazily, issuing a ranged GET after every seek
+func (s *S3) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{s3: s, ctx: ctx, key: key, size: info.Size}, nil
+}
+
+// Delete removes the object stored under key
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if key == "" {
+		return ErrInvalidKey
+	}
+	_, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	return err
+}
+
+// Stat describes the object stored under key
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	if key == "" {
+		return Info{}, ErrInvalidKey
+	}
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return Info{}, err
+	}
+	if resp.ContentLength < 0 {
+		return Info{}, fmt.Errorf("storage: missing Content-Length for %q", key)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Info{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// List pages through ListObjectsV2 until every matching key has been collected
+func (s *S3) List(ctx context.Context, prefix string) ([]Info, error) {
+	var infos []Info
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(resp.Body, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			infos = append(infos, Info{Key: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3Response - the parts of a buffered response callers need
+type s3Response struct {
+	Header        http.Header
+	Body          []byte
+	ContentLength int64
+}
+
+// do sends a signed request for key and buffers the response, treating any status
+// outside expected as an error
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte, expected ...int) (*s3Response, error) {
+	resp, err := s.send(ctx, method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return &s3Response{Header: resp.Header, Body: data, ContentLength: resp.ContentLength}, nil
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	return nil, fmt.Errorf("storage: S3 %s %q returned %s: %s", method, key, resp.Status, bytes.TrimSpace(data))
+}
+
+// send builds, signs and sends a request for key, leaving the response body to the caller
+func (s *S3) send(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.cfg.PathStyle {
+		path += "/" + s.cfg.Bucket
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = path + "/" + key
+	u.RawPath = uriEncode(path, false) + "/" + uriEncode(key, false)
+	u.RawQuery = canonicalQuery(query)
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signV4(req, s.cfg.AccessKeyID, s.cfg.SecretAccessKey, s.cfg.Region, unsignedPayload, s.now())
+
+	return s.client.Do(req)
+}
+
+// s3Object - lazily fetched, seekable view of an S3 object
+type s3Object struct {
+	s3     *S3
+	ctx    context.Context
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		resp, err := o.s3.send(o.ctx, http.MethodGet, o.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusNotFound {
+				return 0, ErrNotExist
+			}
+			return 0, fmt.Errorf("storage: S3 GET %q returned %s", o.key, resp.Status)
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+	if abs != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req
+func signV4(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// sign the host plus every header S3 cares about that the request carries
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		",SignedHeaders="+signedHeaders+",Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by name, as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but the RFC 3986 unreserved characters,
+// leaving slashes alone unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
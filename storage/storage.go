@@ -0,0 +1,36 @@
+// Package storage abstracts where uploaded media files are kept
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotExist is returned when the requested key has no stored object
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// ErrInvalidKey is returned for keys that can't be mapped onto the backend
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// Info - description of a stored object
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage - backend holding uploaded files, addressed by slash separated keys
+type Storage interface {
+	// Put stores everything read from r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader) (Info, error)
+	// Get opens the object stored under key
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Delete removes the object stored under key, deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// Stat describes the object stored under key
+	Stat(ctx context.Context, key string) (Info, error)
+	// List describes every object whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]Info, error)
+}